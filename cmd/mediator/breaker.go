@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errBreakerOpen = errors.New("room service circuit breaker is open")
+
+type breakerState string
+
+const (
+	// breakerClosed lets every call through.
+	breakerClosed breakerState = "closed"
+
+	// breakerOpen fails every call fast, until the cooldown period elapses.
+	breakerOpen breakerState = "open"
+
+	// breakerHalfOpen lets a single trial call through, to probe whether the room service recovered.
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// breaker is a circuit breaker guarding the calls to the room service.
+// It opens after a number of consecutive failures, and probes the room service again after a cooldown period.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+// breakerStatus is a snapshot of the breaker state, as exposed over HTTP.
+type breakerStatus struct {
+	State    breakerState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt *time.Time   `json:"openedAt,omitempty"`
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a call may go through. Every allowed call must be followed by a call to Report.
+func (b *breaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Report records the outcome of an allowed call.
+func (b *breaker) Report(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		if b.state != breakerOpen {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// Release gives back an allowed call whose outcome says nothing about the room service (e.g., a canceled call).
+func (b *breaker) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+// Status returns a snapshot of the breaker state.
+func (b *breaker) Status() breakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := breakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+	}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
+
+// ServeHTTP exposes the breaker state as JSON.
+func (b *breaker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bytes, _ := json.Marshal(b.Status())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+func (b *breaker) transition(state breakerState) {
+	logrus.Warnf("Room service circuit breaker: %s -> %s (%d consecutive failures)", b.state, state, b.failures)
+	b.state = state
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(threshold int, cooldown time.Duration) (*breaker, *time.Time) {
+	b := newBreaker(threshold, cooldown)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+// fail lets the given number of calls through, each failing.
+func fail(t *testing.T, b *breaker, calls int) {
+	for i := 0; i < calls; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() = false at failure %d, state %s", i+1, b.Status().State)
+		}
+		b.Report(false)
+	}
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+	b, _ := newTestBreaker(3, time.Minute)
+
+	fail(t, b, 2)
+	if status := b.Status(); status.State != breakerClosed || status.Failures != 2 {
+		t.Fatalf("Status() after 2 failures = %+v, want closed", status)
+	}
+
+	// A success resets the count
+	b.Allow()
+	b.Report(true)
+	fail(t, b, 2)
+	if state := b.Status().State; state != breakerClosed {
+		t.Fatalf("state after a success and 2 failures = %s, want closed", state)
+	}
+
+	fail(t, b, 1)
+	if status := b.Status(); status.State != breakerOpen || status.OpenedAt == nil {
+		t.Fatalf("Status() after 3 failures = %+v, want open", status)
+	}
+	if b.Allow() {
+		t.Errorf("Allow() while open = true, want false")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe bool
+		state breakerState
+	}{
+		{"successful probe", true, breakerClosed},
+		{"failed probe", false, breakerOpen},
+	}
+
+	for _, test := range tests {
+		b, now := newTestBreaker(2, time.Minute)
+		fail(t, b, 2)
+
+		*now = now.Add(time.Minute - time.Second)
+		if b.Allow() {
+			t.Fatalf("%s: Allow() before the cooldown = true, want false", test.name)
+		}
+
+		*now = now.Add(time.Second)
+		if !b.Allow() {
+			t.Fatalf("%s: Allow() after the cooldown = false, want a probe", test.name)
+		}
+		if state := b.Status().State; state != breakerHalfOpen {
+			t.Fatalf("%s: state after the cooldown = %s, want half-open", test.name, state)
+		}
+		if b.Allow() {
+			t.Fatalf("%s: Allow() while probing = true, want a single probe", test.name)
+		}
+
+		b.Report(test.probe)
+		if state := b.Status().State; state != test.state {
+			t.Errorf("%s: state = %s, want %s", test.name, state, test.state)
+		}
+		if allowed := b.Allow(); allowed != test.probe {
+			t.Errorf("%s: Allow() after the probe = %v, want %v", test.name, allowed, test.probe)
+		}
+	}
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b, now := newTestBreaker(2, time.Minute)
+
+	fail(t, b, 1)
+	b.Allow()
+	b.Release()
+	if status := b.Status(); status.State != breakerClosed || status.Failures != 1 {
+		t.Errorf("Status() after a release = %+v, want closed with 1 failure", status)
+	}
+
+	// A released probe lets another one through, without closing or reopening the breaker
+	fail(t, b, 1)
+	*now = now.Add(time.Minute)
+	b.Allow()
+	b.Release()
+	if status := b.Status(); status.State != breakerHalfOpen || status.Failures != 2 {
+		t.Errorf("Status() after a released probe = %+v, want half-open with 2 failures", status)
+	}
+	if !b.Allow() {
+		t.Errorf("Allow() after a released probe = false, want another probe")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const (
+	broadcastPath        = "/broadcast"
+	broadcastReplicaHdr  = "X-Broadcast-Replica"
+	broadcastQueueSize   = 1024
+	broadcastTimeout     = 5 * time.Second
+	broadcastMaxDateSkew = time.Minute
+)
+
+// Broadcaster carries room messages to the mediator replicas their recipients are connected to.
+// Each replica hands the broadcaster a delivery function, called with every message published by any replica;
+// the function sends the message to the recipients connected to that replica (if any).
+type Broadcaster interface {
+	// Publish delivers the message to its recipients, a player or everyone, wherever they are connected.
+	Publish(msg *gameon.Message) error
+}
+
+// newBroadcaster creates the broadcaster configured for the mediator.
+// Without BROADCAST_PEERS, the mediator runs as a single replica, and messages are delivered in-process.
+func newBroadcaster(deliver func(*gameon.Message)) Broadcaster {
+	peers := os.Getenv("BROADCAST_PEERS")
+	if peers == "" {
+		return newLocalBus().Broadcaster(deliver)
+	}
+
+	secret := os.Getenv("BROADCAST_SECRET")
+	if secret == "" {
+		panic("BROADCAST_PEERS requires BROADCAST_SECRET to be set")
+	}
+
+	return newPeerBroadcaster(deliver, strings.Split(peers, ","), []byte(secret))
+}
+
+// localBus is an in-memory broadcaster hub. With a single member, it serves a mediator running as a single replica.
+// With several members, it connects in-process mediators, standing in for a network of replicas.
+// Every message published by one of the bus broadcasters is delivered by all of them, in publishing order.
+type localBus struct {
+	members []func(*gameon.Message)
+	mutex   sync.Mutex
+}
+
+func newLocalBus() *localBus {
+	return &localBus{}
+}
+
+// Broadcaster attaches a new replica to the bus.
+func (bus *localBus) Broadcaster(deliver func(*gameon.Message)) Broadcaster {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.members = append(bus.members, deliver)
+	return &localBusBroadcaster{bus: bus}
+}
+
+type localBusBroadcaster struct {
+	bus *localBus
+}
+
+func (b *localBusBroadcaster) Publish(msg *gameon.Message) error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+
+	for _, deliver := range b.bus.members {
+		// Each replica gets its own copy, as delivery may stamp or record it
+		copied := *msg
+		deliver(&copied)
+	}
+
+	return nil
+}
+
+// peerBroadcaster delivers messages locally, and forwards them to a static list of peer replicas over HTTP.
+// Peers deliver the messages they receive locally, without forwarding them any further.
+// Requests are signed with a secret shared by all replicas.
+type peerBroadcaster struct {
+	replicaID string
+	secret    []byte
+	deliver   func(*gameon.Message)
+	peers     []*broadcastPeer
+}
+
+// broadcastPeer queues the messages forwarded to a peer, so that a slow peer doesn't hold back publishing,
+// and messages reach it in publishing order.
+type broadcastPeer struct {
+	url   string
+	queue chan []byte
+}
+
+func newPeerBroadcaster(deliver func(*gameon.Message), peerURLs []string, secret []byte) *peerBroadcaster {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	b := &peerBroadcaster{
+		replicaID: hex.EncodeToString(id),
+		secret:    secret,
+		deliver:   deliver,
+	}
+
+	client := &http.Client{Timeout: broadcastTimeout}
+	for _, url := range peerURLs {
+		url = strings.TrimSuffix(strings.TrimSpace(url), "/")
+		if url == "" {
+			continue
+		}
+
+		peer := &broadcastPeer{
+			url:   url + broadcastPath,
+			queue: make(chan []byte, broadcastQueueSize),
+		}
+		b.peers = append(b.peers, peer)
+		go b.forward(client, peer)
+	}
+
+	logrus.Infof("Broadcasting to %d peer replicas as replica %s", len(b.peers), b.replicaID)
+	return b
+}
+
+func (b *peerBroadcaster) Publish(msg *gameon.Message) error {
+	b.deliver(msg)
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range b.peers {
+		select {
+		case peer.queue <- body:
+		default:
+			logrus.Warnf("Broadcast queue full for peer %s, dropping message", peer.url)
+		}
+	}
+
+	return nil
+}
+
+func (b *peerBroadcaster) forward(client *http.Client, peer *broadcastPeer) {
+	for body := range peer.queue {
+		req, err := http.NewRequest("POST", peer.url, bytes.NewReader(body))
+		if err != nil {
+			logrus.WithError(err).Errorf("Error creating broadcast request for peer %s", peer.url)
+			continue
+		}
+
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(broadcastReplicaHdr, b.replicaID)
+		req.Header.Set(gameon.SignatureDateHeader, date)
+		req.Header.Set(gameon.SignatureHeader, gameon.Sign(b.secret, b.replicaID, date, string(body)))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error forwarding message to peer %s", peer.url)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			logrus.Errorf("Peer %s rejected forwarded message with %d %s", peer.url, resp.StatusCode, resp.Status)
+		}
+	}
+}
+
+// ServeHTTP receives the messages forwarded by peer replicas, and delivers them locally.
+func (b *peerBroadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = b.verify(r, body)
+	if err != nil {
+		logrus.WithError(err).Errorf("Rejecting broadcast from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var msg gameon.Message
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b.deliver(&msg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *peerBroadcaster) verify(r *http.Request, body []byte) error {
+	replicaID := r.Header.Get(broadcastReplicaHdr)
+	date := r.Header.Get(gameon.SignatureDateHeader)
+	signature := r.Header.Get(gameon.SignatureHeader)
+
+	if replicaID == b.replicaID {
+		return fmt.Errorf("message originated from this replica")
+	}
+
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("invalid broadcast date: %s", date)
+	}
+
+	skew := time.Since(signedAt)
+	if skew < -broadcastMaxDateSkew || skew > broadcastMaxDateSkew {
+		return fmt.Errorf("stale broadcast date: %s", date)
+	}
+
+	if !gameon.VerifySignature(b.secret, signature, replicaID, date, string(body)) {
+		return fmt.Errorf("broadcast signature mismatch for replica %s", replicaID)
+	}
+
+	return nil
+}
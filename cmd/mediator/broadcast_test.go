@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+	"github.com/gorilla/websocket"
+)
+
+// testReplica is a mediator replica attached to a local bus, along with a server accepting its websockets.
+type testReplica struct {
+	m        *mediator
+	server   *httptest.Server
+	sessions chan *Session
+}
+
+func newTestReplica(bus *localBus) *testReplica {
+	r := &testReplica{
+		m:        &mediator{sessions: newSessions(), replay: newReplayBuffer()},
+		sessions: make(chan *Session, 1),
+	}
+	r.m.broadcaster = bus.Broadcaster(r.m.deliver)
+
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		r.sessions <- r.m.sessions.NewSession(conn)
+	}))
+
+	return r
+}
+
+// connect opens a websocket to the replica, carrying the given players in the given room.
+func (r *testReplica) connect(t *testing.T, roomID string, users ...gameon.UserInfo) (*websocket.Conn, *Session) {
+	url := "ws" + strings.TrimPrefix(r.server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial(%s): %v", url, err)
+	}
+
+	session := <-r.sessions
+	session.SetVersion(2)
+	for _, userInfo := range users {
+		session.AddUser(userInfo, roomID)
+	}
+
+	return conn, session
+}
+
+func (r *testReplica) Close() {
+	for _, session := range r.m.sessions.GetOpenSessions() {
+		session.Close()
+	}
+	r.server.Close()
+}
+
+// expectMessages reads the next frames off the connection, and checks they're addressed to the given recipients.
+func expectMessages(t *testing.T, name string, conn *websocket.Conn, recipients ...string) {
+	for _, recipient := range recipients {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: reading a message for %s: %v", name, recipient, err)
+		}
+
+		msg, err := gameon.ParseMessage(frame)
+		if err != nil {
+			t.Fatalf("%s: ParseMessage(%q): %v", name, frame, err)
+		}
+		if msg.Recipient != recipient {
+			t.Errorf("%s: got a message for %s (%q), want one for %s", name, msg.Recipient, frame, recipient)
+		}
+	}
+}
+
+func newTestMessage(t *testing.T, recipient, roomID, content string) *gameon.Message {
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, recipient, gameon.Event{
+		Type:    "event",
+		Content: map[string]string{"*": content},
+	})
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	msg.Room = roomID
+	return msg
+}
+
+func TestLocalBusDeliversAcrossReplicas(t *testing.T) {
+	bus := newLocalBus()
+	a, b := newTestReplica(bus), newTestReplica(bus)
+	defer a.Close()
+	defer b.Close()
+
+	alice := gameon.UserInfo{UserID: "dummy.alice", Username: "alice"}
+	bob := gameon.UserInfo{UserID: "dummy.bob", Username: "bob"}
+	carol := gameon.UserInfo{UserID: "dummy.carol", Username: "carol"}
+	dave := gameon.UserInfo{UserID: "dummy.dave", Username: "dave"}
+
+	// alice is on replica a, bob on replica b, carol is on replica b too but elsewhere,
+	// and dave is in the room over both replicas
+	aliceConn, _ := a.connect(t, "lounge", alice)
+	bobConn, bobSession := b.connect(t, "lounge", bob)
+	bobSession.AddUser(carol, "cellar")
+	daveConnA, _ := a.connect(t, "lounge", dave)
+	daveConnB, _ := b.connect(t, "lounge", dave)
+
+	// Each test ends with messages for everyone in either room, so that connections can be checked
+	// for not getting more than expected
+	end := func(r *testReplica) {
+		r.m.handleResponse(&gameon.MessageCollection{Messages: []gameon.Message{
+			*newTestMessage(t, gameon.AllRecipients, "lounge", "That's all in the lounge"),
+			*newTestMessage(t, gameon.AllRecipients, "cellar", "That's all in the cellar"),
+		}})
+	}
+
+	t.Run("room-wide", func(t *testing.T) {
+		a.m.handleResponse(&gameon.MessageCollection{Messages: []gameon.Message{
+			*newTestMessage(t, gameon.AllRecipients, "lounge", "Welcome to the lounge"),
+		}})
+		end(a)
+
+		expectMessages(t, "alice", aliceConn, gameon.AllRecipients, gameon.AllRecipients)
+		// bob shares a session with carol, who's in another room, so each gets a copy of their own
+		expectMessages(t, "bob and carol", bobConn, bob.UserID, bob.UserID, carol.UserID)
+		expectMessages(t, "dave on a", daveConnA, gameon.AllRecipients, gameon.AllRecipients)
+		expectMessages(t, "dave on b", daveConnB, gameon.AllRecipients, gameon.AllRecipients)
+	})
+
+	t.Run("user-addressed", func(t *testing.T) {
+		b.m.handleResponse(&gameon.MessageCollection{Messages: []gameon.Message{
+			*newTestMessage(t, alice.UserID, "lounge", "Psst, alice"),
+			*newTestMessage(t, dave.UserID, "lounge", "Psst, dave"),
+		}})
+		end(b)
+
+		expectMessages(t, "alice", aliceConn, alice.UserID, gameon.AllRecipients)
+		expectMessages(t, "bob and carol", bobConn, bob.UserID, carol.UserID)
+		expectMessages(t, "dave on a", daveConnA, dave.UserID, gameon.AllRecipients)
+		expectMessages(t, "dave on b", daveConnB, dave.UserID, gameon.AllRecipients)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/env"
+)
+
+const defaultReconnectGracePeriod = 30 * time.Second
+
+// departures holds the goodbyes said on behalf of the players whose connection died (see mediator.farewell)
+// for a grace period, set with RECONNECT_GRACE_PERIOD, so that players recovering their session in the meantime
+// stay in the room and get the messages they missed. Zero says goodbye right away.
+type departures struct {
+	gracePeriod time.Duration
+
+	// pending maps the IDs of the departed players to the timers saying goodbye for them.
+	pending map[string]*time.Timer
+	mutex   sync.Mutex
+}
+
+func newDepartures() *departures {
+	return &departures{
+		gracePeriod: env.Duration("RECONNECT_GRACE_PERIOD", defaultReconnectGracePeriod),
+		pending:     make(map[string]*time.Timer),
+	}
+}
+
+// Schedule calls depart once the grace period is over, unless the player comes back before (see Cancel).
+// It replaces the departure already pending for the player, if any.
+func (d *departures) Schedule(userID string, depart func()) {
+	if d.gracePeriod == 0 {
+		d.Cancel(userID)
+		depart()
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if timer, ok := d.pending[userID]; ok {
+		timer.Stop()
+	}
+
+	// The timer's function waits for the lock, by which time timer is set, to tell whether it was replaced or canceled
+	var timer *time.Timer
+	timer = time.AfterFunc(d.gracePeriod, func() {
+		d.mutex.Lock()
+		current := d.pending[userID] == timer
+		if current {
+			delete(d.pending, userID)
+		}
+		d.mutex.Unlock()
+
+		if current {
+			depart()
+		}
+	})
+	d.pending[userID] = timer
+}
+
+// Cancel drops the departure pending for the player, and reports whether there was one.
+func (d *departures) Cancel(userID string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	timer, ok := d.pending[userID]
+	if ok {
+		timer.Stop()
+		delete(d.pending, userID)
+	}
+	return ok
+}
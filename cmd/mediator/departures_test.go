@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDepartures(t *testing.T) {
+	d := &departures{gracePeriod: 20 * time.Millisecond, pending: make(map[string]*time.Timer)}
+	departed := make(chan string, 3)
+	depart := func(name string) func() {
+		return func() { departed <- name }
+	}
+
+	// alice comes back in time, and bob's first departure is replaced by the second one
+	d.Schedule("alice", depart("alice"))
+	d.Schedule("bob", depart("bob, first"))
+	d.Schedule("bob", depart("bob, second"))
+	if !d.Cancel("alice") {
+		t.Errorf("Cancel(alice) = false, want the departure canceled")
+	}
+	if d.Cancel("carol") {
+		t.Errorf("Cancel(carol) = true, without any departure pending")
+	}
+
+	select {
+	case name := <-departed:
+		if name != "bob, second" {
+			t.Errorf("departed %s, want bob's second departure", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("bob didn't depart")
+	}
+
+	select {
+	case name := <-departed:
+		t.Errorf("departed %s, want bob only", name)
+	case <-time.After(5 * d.gracePeriod):
+	}
+
+	if d.Cancel("bob") {
+		t.Errorf("Cancel(bob) = true after departing")
+	}
+}
+
+func TestDeparturesWithoutGracePeriod(t *testing.T) {
+	d := &departures{pending: make(map[string]*time.Timer)}
+
+	departed := false
+	d.Schedule("alice", func() { departed = true })
+	if !departed {
+		t.Errorf("Schedule() without a grace period didn't depart right away")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const defaultHandshakeMaxAge = 5 * time.Minute
+
+type handshakeMode string
+
+const (
+	// handshakeEnforce rejects websocket upgrades failing verification.
+	handshakeEnforce handshakeMode = "enforce"
+
+	// handshakePermissive logs verification failures, but lets the upgrade go through.
+	handshakePermissive handshakeMode = "permissive"
+
+	// handshakeDisabled skips verification altogether.
+	handshakeDisabled handshakeMode = "disabled"
+)
+
+// handshakeVerifier checks the Game On signature headers of an incoming websocket handshake.
+// The signature is the HMAC-SHA256 of the gameon-id and gameon-date headers, keyed with the room's shared secret.
+type handshakeVerifier struct {
+	secret []byte
+	mode   handshakeMode
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+func newHandshakeVerifier() *handshakeVerifier {
+	secret := os.Getenv("GAMEON_SECRET")
+
+	mode := handshakeMode(strings.ToLower(os.Getenv("HANDSHAKE_VERIFICATION")))
+	switch mode {
+	case "":
+		if secret == "" {
+			mode = handshakeDisabled
+		} else {
+			mode = handshakeEnforce
+		}
+	case handshakeEnforce, handshakePermissive, handshakeDisabled:
+	default:
+		panic(fmt.Sprintf("unsupported handshake verification mode: %s", mode))
+	}
+
+	if mode != handshakeDisabled && secret == "" {
+		panic(fmt.Sprintf("handshake verification mode '%s' requires GAMEON_SECRET to be set", mode))
+	}
+
+	maxAge := env.PositiveDuration("HANDSHAKE_MAX_AGE", defaultHandshakeMaxAge)
+
+	if mode == handshakeDisabled {
+		logrus.Warnf("Websocket handshake verification is disabled")
+	}
+
+	return &handshakeVerifier{
+		secret: []byte(secret),
+		mode:   mode,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+// Allow verifies the handshake request, and reports whether the websocket upgrade may proceed.
+func (v *handshakeVerifier) Allow(r *http.Request) bool {
+	if v.mode == handshakeDisabled {
+		return true
+	}
+
+	err := v.verify(r)
+	if err == nil {
+		return true
+	}
+
+	if v.mode == handshakePermissive {
+		logrus.WithError(err).Warnf("Websocket handshake verification failed for %s (permissive mode, allowing)", r.RemoteAddr)
+		return true
+	}
+
+	logrus.WithError(err).Errorf("Websocket handshake verification failed for %s", r.RemoteAddr)
+	return false
+}
+
+func (v *handshakeVerifier) verify(r *http.Request) error {
+	id := r.Header.Get(gameon.SignatureIDHeader)
+	date := r.Header.Get(gameon.SignatureDateHeader)
+	signature := r.Header.Get(gameon.SignatureHeader)
+
+	if id == "" || date == "" || signature == "" {
+		return fmt.Errorf("missing signature headers")
+	}
+
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("invalid signature date: %s", date)
+	}
+
+	age := v.now().Sub(signedAt)
+	if age < -v.maxAge || age > v.maxAge {
+		return fmt.Errorf("stale signature date: %s", date)
+	}
+
+	if !gameon.VerifySignature(v.secret, signature, id, date) {
+		return fmt.Errorf("signature mismatch for id %s", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func newHandshake(secret []byte, id string, signedAt time.Time) *http.Request {
+	req, _ := http.NewRequest("GET", "http://mediator/", nil)
+	date := signedAt.UTC().Format(http.TimeFormat)
+	req.Header.Set(gameon.SignatureIDHeader, id)
+	req.Header.Set(gameon.SignatureDateHeader, date)
+	req.Header.Set(gameon.SignatureHeader, gameon.Sign(secret, id, date))
+	return req
+}
+
+func TestHandshakeVerifier(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+
+		// allowed is whether the upgrade goes through in enforce mode; it always does in permissive mode.
+		allowed bool
+	}{
+		{"valid", newHandshake(secret, "game-on.org", now), true},
+		{"slightly skewed", newHandshake(secret, "game-on.org", now.Add(time.Minute)), true},
+		{"wrong secret", newHandshake([]byte("guess"), "game-on.org", now), false},
+		{"too old", newHandshake(secret, "game-on.org", now.Add(-time.Hour)), false},
+		{"in the future", newHandshake(secret, "game-on.org", now.Add(time.Hour)), false},
+		{"missing id", newHandshake(secret, "game-on.org", now), false},
+		{"missing date", newHandshake(secret, "game-on.org", now), false},
+		{"missing signature", newHandshake(secret, "game-on.org", now), false},
+		{"invalid date", newHandshake(secret, "game-on.org", now), false},
+		{"other id", newHandshake(secret, "game-on.org", now), false},
+	}
+	tests[5].req.Header.Del(gameon.SignatureIDHeader)
+	tests[6].req.Header.Del(gameon.SignatureDateHeader)
+	tests[7].req.Header.Del(gameon.SignatureHeader)
+	tests[8].req.Header.Set(gameon.SignatureDateHeader, "yesterday")
+	tests[9].req.Header.Set(gameon.SignatureIDHeader, "someone.else")
+
+	for _, mode := range []handshakeMode{handshakeEnforce, handshakePermissive} {
+		v := &handshakeVerifier{secret: secret, mode: mode, maxAge: defaultHandshakeMaxAge, now: func() time.Time { return now }}
+
+		for _, test := range tests {
+			want := test.allowed || mode == handshakePermissive
+			if allowed := v.Allow(test.req); allowed != want {
+				t.Errorf("%s: %s: Allow() = %v, want %v", mode, test.name, allowed, want)
+			}
+			if err := v.verify(test.req); (err == nil) != test.allowed {
+				t.Errorf("%s: %s: verify() = %v, want an error: %v", mode, test.name, err, !test.allowed)
+			}
+		}
+	}
+}
+
+func TestNewHandshakeVerifierModes(t *testing.T) {
+	tests := []struct {
+		secret, mode string
+		want         handshakeMode
+	}{
+		{"", "", handshakeDisabled},
+		{"secret", "", handshakeEnforce},
+		{"secret", "PERMISSIVE", handshakePermissive},
+		{"secret", "disabled", handshakeDisabled},
+	}
+
+	for _, test := range tests {
+		defer setenv("GAMEON_SECRET", test.secret)()
+		defer setenv("HANDSHAKE_VERIFICATION", test.mode)()
+
+		if v := newHandshakeVerifier(); v.mode != test.want {
+			t.Errorf("newHandshakeVerifier(secret %q, mode %q) mode = %s, want %s", test.secret, test.mode, v.mode, test.want)
+		}
+	}
+
+	// Verification can't be enforced without a secret
+	defer setenv("GAMEON_SECRET", "")()
+	defer setenv("HANDSHAKE_VERIFICATION", "enforce")()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("newHandshakeVerifier(enforce without secret) succeeded, want a panic")
+		}
+	}()
+	newHandshakeVerifier()
+}
+
+// setenv sets an environment variable, and returns a function restoring it.
+func setenv(key, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 60 * time.Second
+	defaultIdleTimeout  = 30 * time.Minute
+)
+
+// keepaliveConfig holds the websocket liveness settings.
+type keepaliveConfig struct {
+	// pingInterval is the interval at which pings are sent to the peer.
+	pingInterval time.Duration
+
+	// pongTimeout is how long the connection may go without any frame (including pongs)
+	// from the peer, before it is considered dead.
+	pongTimeout time.Duration
+
+	// idleTimeout is how long a session may go without any message from the peer, before it is reaped.
+	// Pongs don't count as activity. Zero disables idle reaping.
+	idleTimeout time.Duration
+}
+
+func newKeepaliveConfig() keepaliveConfig {
+	config := keepaliveConfig{
+		pingInterval: env.Duration("PING_INTERVAL", defaultPingInterval),
+		pongTimeout:  env.Duration("PONG_TIMEOUT", defaultPongTimeout),
+		idleTimeout:  env.Duration("IDLE_TIMEOUT", defaultIdleTimeout),
+	}
+
+	if config.pingInterval <= 0 || config.pongTimeout <= config.pingInterval {
+		panic(fmt.Sprintf("pong timeout (%s) must be greater than a positive ping interval (%s)", config.pongTimeout, config.pingInterval))
+	}
+
+	return config
+}
+
+// watchPongs arms the read deadline of the session's connection, and extends it whenever a pong arrives.
+// It must be called before the session's read loop starts.
+func (m *mediator) watchPongs(session *Session) {
+	m.extendReadDeadline(session)
+	session.Conn.SetPongHandler(func(string) error {
+		m.extendReadDeadline(session)
+		return nil
+	})
+}
+
+func (m *mediator) extendReadDeadline(session *Session) {
+	session.Conn.SetReadDeadline(time.Now().Add(m.keepalive.pongTimeout))
+}
+
+// keepAlive pings the peer periodically, and reaps the session once it goes idle.
+// It returns when the session is closed.
+func (m *mediator) keepAlive(session *Session) {
+	ticker := time.NewTicker(m.keepalive.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.Closed():
+			return
+		case <-ticker.C:
+		}
+
+		if m.keepalive.idleTimeout > 0 && session.IdleFor() > m.keepalive.idleTimeout {
+			m.reap(session)
+			return
+		}
+
+		deadline := time.Now().Add(m.keepalive.pingInterval)
+		err := session.Conn.WriteControl(websocket.PingMessage, nil, deadline)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error sending ping to %s", session.Conn.RemoteAddr().String())
+			session.CloseWithReason(websocket.CloseGoingAway, "Ping failed")
+			return
+		}
+	}
+}
+
+// reap closes an idle session, letting the room service know about players who aren't connected elsewhere.
+func (m *mediator) reap(session *Session) {
+	logrus.Infof("Reaping idle session with %s", session.Conn.RemoteAddr().String())
+
+	for _, userInfo := range session.Users() {
+		roomID := session.Room(userInfo.UserID)
+		last := session.RemoveUser(userInfo.UserID)
+		if !last {
+			continue
+		}
+		m.replay.Forget(userInfo.UserID)
+
+		resp, err := m.room.Goodbye(session.Context(), roomID, &gameon.Goodbye{UserInfo: userInfo})
+		if err != nil {
+			logRoomError(err, "goodbye", userInfo.UserID)
+			continue
+		}
+
+		m.handleResponse(resp)
+	}
+
+	session.CloseWithReason(websocket.CloseNormalClosure, "Idle timeout")
+}
@@ -1,21 +1,85 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
 )
 
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
+
+	if len(os.Args) > 1 && os.Args[1] == "register" {
+		err := registerRoom()
+		if err != nil {
+			logrus.WithError(err).Fatalf("Error registering room")
+		}
+		return
+	}
+
 	logrus.Infof("Starting mediator service")
 
+	if strings.ToLower(os.Getenv("REGISTER_ON_STARTUP")) == "true" {
+		err := registerRoom()
+		if err != nil {
+			logrus.WithError(err).Errorf("Error registering room")
+		}
+	}
+
 	m := newMediator()
+	gracePeriod := env.Duration("SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod)
+
+	pushCtx, stopPush := context.WithCancel(context.Background())
+	if strings.ToLower(os.Getenv("ROOM_PUSH")) != "false" {
+		go m.room.subscribe(pushCtx, m.handlePush)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.handleHTTP)
+	mux.Handle("/status/breaker", m.room.breaker)
+	if handler, ok := m.broadcaster.(http.Handler); ok {
+		mux.Handle(broadcastPath, handler)
+	}
+	server := &http.Server{Addr: ":3000", Handler: mux}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+
+		logrus.Infof("Received %s, shutting down (grace period: %s)", sig, gracePeriod)
 
-	http.HandleFunc("/", m.handleHTTP)
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
 
-	err := http.ListenAndServe(":3000", nil)
-	if err != nil {
+		stopPush()
+
+		// Websocket connections are hijacked, so the server doesn't wait for them; the mediator drains them itself
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error shutting down HTTP server")
+		}
+
+		err = m.Shutdown(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error draining websocket sessions")
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		logrus.WithError(err).Fatalf("Error running main")
 	}
+
+	<-shutdownDone
+	logrus.Infof("Mediator service stopped")
 }
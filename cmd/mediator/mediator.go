@@ -1,37 +1,73 @@
 package main
 
 import (
-	"encoding/json"
-	"net/http"
-
+	"context"
+	"errors"
 	"fmt"
-
+	"net/http"
 	"os"
-
-	"bytes"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
 	"github.com/gameontext/a8-room/pkg/gameon"
 	"github.com/gorilla/websocket"
 )
 
 var (
-	SupportedVersions = []int{1}
+	// SupportedVersions lists the Game On protocol versions advertised in the ack message.
+	SupportedVersions = []int{1, 2}
+
+	errUnexpectedPayload = errors.New("unexpected message payload")
+)
+
+// Messages sent to a player whose command the room service failed to handle.
+const (
+	roomErrorMessage       = "The room seems distracted, try again"
+	roomUnavailableMessage = "The room is having a nap, try again in a little while"
 )
 
 type mediator struct {
-	room     *room
-	roomID   string
-	sessions *SessionManager
+	room      *room
+	roomIDs   map[string]bool
+	sessions  *SessionManager
+	handshake *handshakeVerifier
+	keepalive keepaliveConfig
+	replay    *replayBuffer
+
+	// departures holds the goodbyes of the players whose connection died, until they're past recovering it.
+	departures *departures
+
+	// broadcaster carries messages to the mediator replicas their recipients are connected to.
+	broadcaster Broadcaster
+
+	// maxInflight bounds the number of messages queued or in progress per session.
+	maxInflight int
+
+	// draining is set once shutdown starts, and inflight tracks the room service calls in progress.
+	// closing is set once every session was closed, and farewells tracks the goodbyes and parts
+	// received while draining.
+	draining   bool
+	closing    bool
+	inflight   sync.WaitGroup
+	farewells  sync.WaitGroup
+	drainMutex sync.Mutex
 }
 
 func newMediator() *mediator {
 	m := &mediator{
-		room:     newRoom(),
-		roomID:   os.Getenv("ROOM_ID"),
-		sessions: newSessions(),
+		room:       newRoom(),
+		roomIDs:    hostedRoomIDs(),
+		sessions:   newSessions(),
+		handshake:  newHandshakeVerifier(),
+		keepalive:  newKeepaliveConfig(),
+		replay:     newReplayBuffer(),
+		departures: newDepartures(),
+
+		maxInflight: env.PositiveInt("SESSION_MAX_INFLIGHT", defaultMaxInflight),
 	}
+	m.broadcaster = newBroadcaster(m.deliver)
 
 	return m
 }
@@ -39,6 +75,16 @@ func newMediator() *mediator {
 func (m *mediator) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	logrus.Debugf("Incoming HTTP request from %s", r.RemoteAddr)
 
+	if m.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if !m.handshake.Allow(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	var upgrader websocket.Upgrader
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -54,18 +100,26 @@ func (m *mediator) handleWebsocket(conn *websocket.Conn) {
 	session := m.sessions.NewSession(conn)
 
 	m.ack(session)
+	m.watchPongs(session)
 	go m.handleMessages(session)
+	go m.keepAlive(session)
 
-	select {
-	case <-session.Closed():
-		conn.Close()
-	}
+	<-session.Closed()
+	<-session.Flushed()
+	conn.Close()
 }
 
 func (m *mediator) handleMessages(session *Session) {
+	commands := newPipeline(m, session)
+
 	// The loop runs forever, and is terminated only when an error occurs.
-	// In such a case, attempt to close the session (in case not closed already).
-	defer session.Close()
+	// In such a case, attempt to close the session (in case not closed already),
+	// and see the players off once their pending messages went through.
+	defer func() {
+		session.Close()
+		commands.Wait()
+		m.farewell(session)
+	}()
 
 	for {
 		_, bytes, err := session.Conn.ReadMessage()
@@ -74,104 +128,349 @@ func (m *mediator) handleMessages(session *Session) {
 			return
 		}
 
-		msg, err := parseMessage(bytes)
+		session.Touch()
+		m.extendReadDeadline(session)
+
+		msg, payload, err := gameon.DecodeMessage(bytes)
 		if err != nil {
-			logrus.WithError(err).Errorf("Error parsing websocket message")
+			logrus.WithError(err).Errorf("Error decoding websocket message")
+			session.CloseWithReason(websocket.CloseUnsupportedData, "Invalid message")
 			return
 		}
 
 		logrus.WithFields(messageToFields(msg)).Debugf("Websocket message received")
 
-		// Validate the message recipient is our own room ID
-		if m.roomID != "" && msg.Recipient != m.roomID {
-			logrus.WithError(fmt.Errorf("recipient (%s) doesn't match expected room id (%s)", msg.Recipient, m.roomID)).
+		// Validate the message recipient is one of our own room IDs
+		if len(m.roomIDs) > 0 && !m.roomIDs[msg.Recipient] {
+			logrus.WithError(fmt.Errorf("recipient (%s) isn't a hosted room id", msg.Recipient)).
 				Errorf("Invalid message received")
+			session.CloseWithReason(websocket.ClosePolicyViolation, "Unexpected room ID")
 			return
 		}
 
-		var payload interface{}
-		switch msg.Direction {
-		case "roomHello":
-			payload = &gameon.Hello{}
-		case "roomGoodbye":
-			payload = &gameon.Goodbye{}
-		case "room":
-			payload = &gameon.RoomCommand{}
-		default:
-			logrus.WithError(fmt.Errorf("unrecognized message direction: %s", msg.Direction)).
-				Errorf("Invalid message received")
-			return
-		}
+		// Dispatching goes through the pipeline, so that a slow room service doesn't stall reading
+		commands.Submit(msg, payload)
+	}
+}
 
-		err = json.Unmarshal(msg.Payload, payload)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error unmarshaling message payload")
-			return
-		}
+// hostedRoomIDs returns the IDs of the rooms the mediator accepts messages for,
+// set as a comma separated list with ROOM_IDS (or a single ID with ROOM_ID).
+// An empty set accepts messages for any room.
+func hostedRoomIDs() map[string]bool {
+	value := os.Getenv("ROOM_IDS")
+	if value == "" {
+		value = os.Getenv("ROOM_ID")
+	}
 
-		switch payload := payload.(type) {
-		case *gameon.Hello:
-			m.handleHello(payload, session)
-		case *gameon.Goodbye:
-			m.handleGoodbye(payload, session)
-		case *gameon.RoomCommand:
-			m.handleRoomCommand(payload, session)
-		default:
-			logrus.WithError(fmt.Errorf("unrecognized payload type: %T", payload))
+	roomIDs := make(map[string]bool)
+	for _, roomID := range strings.Split(value, ",") {
+		roomID = strings.TrimSpace(roomID)
+		if roomID != "" {
+			roomIDs[roomID] = true
 		}
 	}
+
+	return roomIDs
+}
+
+// dispatch handles a message received for the given room.
+func (m *mediator) dispatch(ctx context.Context, roomID string, payload interface{}, session *Session) error {
+	switch payload := payload.(type) {
+	case *gameon.Hello:
+		return m.handleHello(ctx, roomID, payload, session)
+	case *gameon.Goodbye:
+		m.handleGoodbye(ctx, roomID, payload, session)
+	case *gameon.Join:
+		return m.handleJoin(ctx, roomID, payload, session)
+	case *gameon.Part:
+		m.handlePart(ctx, roomID, payload, session)
+	case *gameon.RoomCommand:
+		m.handleRoomCommand(ctx, roomID, payload, session)
+	default:
+		return errUnexpectedPayload
+	}
+
+	return nil
 }
 
 func (m *mediator) ack(session *Session) {
 	logrus.Debugf("Sending ack for websocket connection with remote address %s", session.Conn.RemoteAddr().String())
 
-	ack := gameon.Ack{
+	msg, _ := gameon.NewMessage(gameon.DirectionAck, "", gameon.Ack{
 		Version: SupportedVersions,
+	})
+
+	sendMessage(msg, session)
+}
+
+func (m *mediator) handleHello(ctx context.Context, roomID string, hello *gameon.Hello, session *Session) error {
+	err := m.negotiateVersion(hello.Version, session)
+	if err != nil {
+		return err
+	}
+
+	// A player already connected over other sessions may have moved on to another hosted room
+	roomID = m.sessions.UserRoom(hello.UserID, roomID)
+
+	first, err := session.AddUser(hello.UserInfo, roomID)
+	if err != nil {
+		return err
+	}
+	m.comeBack(hello.UserID)
+	if hello.Recovery {
+		// The player is recovering a broken session, so spare everyone another welcome,
+		// and catch the player up with what it missed in the meantime
+		logrus.Debugf("Player %s recovering session from bookmark '%s'", hello.UserID, hello.Bookmark)
+		err = m.join(ctx, roomID, &gameon.Join{UserInfo: hello.UserInfo, Version: hello.Version}, session)
+		m.recover(roomID, hello, session)
+		return err
+	}
+	if !first {
+		// The player is already in the room over another session, so spare everyone another welcome
+		logrus.Debugf("Player %s connected over an additional session", hello.UserID)
+		return m.join(ctx, roomID, &gameon.Join{UserInfo: hello.UserInfo, Version: hello.Version}, session)
 	}
-	ackBytes, _ := json.Marshal(ack)
 
-	msg := &gameon.Message{
-		Direction: "ack",
-		Payload:   ackBytes,
+	resp, err := m.room.Hello(ctx, roomID, hello)
+	if err != nil {
+		m.handleRoomError(err, "hello", hello.UserID, session)
+		return nil
 	}
 
-	sendMessage(msg, session)
+	m.handleResponse(resp)
+	return nil
 }
 
-func (m *mediator) handleHello(hello *gameon.Hello, session *Session) {
-	session.SetUserID(hello.UserID)
+func (m *mediator) handleGoodbye(ctx context.Context, roomID string, goodbye *gameon.Goodbye, session *Session) {
+	// A v1 connection carries a single player, and goes away with it.
+	// A v2 connection may be shared by other players, so only this player is detached from it.
+	if session.Version() < 2 {
+		defer session.Close()
+	}
 
-	resp, err := m.room.Hello(hello)
+	roomID = userRoom(session, goodbye.UserID, roomID)
+	last := session.RemoveUser(goodbye.UserID)
+	if !last {
+		logrus.Debugf("Player %s is still connected over other sessions", goodbye.UserID)
+		return
+	}
+	m.replay.Forget(goodbye.UserID)
+
+	resp, err := m.room.Goodbye(ctx, roomID, goodbye)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing 'hello' with room service")
+		// The player is on its way out, so there's nobody to tell about it
+		logRoomError(err, "goodbye", goodbye.UserID)
 		return
 	}
 
 	m.handleResponse(resp)
+
+	// The player is no longer attached to the session, so deliver its share of the farewell directly.
+	// A session still carrying other players got it along with them.
+	if len(session.Users()) == 0 {
+		for _, msg := range resp.Messages {
+			if msg.Recipient == gameon.AllRecipients || msg.Recipient == goodbye.UserID {
+				sendMessage(&msg, session)
+			}
+		}
+	}
+}
+
+// farewell says goodbye to the room on behalf of the players whose last session closed without them saying
+// goodbye (or parting), e.g. when the connection died, unless they come back within the reconnect grace period
+// (see departures). Players are spared while the mediator is draining, as they're about to reconnect to another replica.
+func (m *mediator) farewell(session *Session) {
+	if m.isDraining() {
+		return
+	}
+
+	for _, userInfo := range session.Departed() {
+		roomID := session.Room(userInfo.UserID)
+		if !session.RemoveUser(userInfo.UserID) {
+			continue
+		}
+
+		userInfo := userInfo
+		m.departures.Schedule(userInfo.UserID, func() {
+			m.depart(roomID, userInfo)
+		})
+	}
+}
+
+// depart says goodbye to the room on behalf of the player, once past recovering its session.
+func (m *mediator) depart(roomID string, userInfo gameon.UserInfo) {
+	if m.isDraining() || len(m.sessions.GetUserSessions(userInfo.UserID)) > 0 {
+		return
+	}
+	m.replay.Forget(userInfo.UserID)
+
+	logrus.Infof("Player %s left without saying goodbye", userInfo.UserID)
+	resp, err := m.room.Goodbye(context.Background(), roomID, &gameon.Goodbye{UserInfo: userInfo})
+	if err != nil {
+		logRoomError(err, "goodbye", userInfo.UserID)
+		return
+	}
+
+	m.handleResponse(resp)
+}
+
+// comeBack cancels the goodbye pending for the player, who's attached to a session again.
+func (m *mediator) comeBack(userID string) {
+	if m.departures.Cancel(userID) {
+		logrus.Debugf("Player %s came back within the reconnect grace period", userID)
+	}
+}
+
+func (m *mediator) handleJoin(ctx context.Context, roomID string, join *gameon.Join, session *Session) error {
+	// roomJoin only exists in v2, so a join without an explicit version implies it
+	version := join.Version
+	if version == 0 {
+		version = 2
+	}
+	if version < 2 {
+		return fmt.Errorf("'%s' is not supported by protocol version %d", gameon.DirectionRoomJoin, version)
+	}
+
+	err := m.negotiateVersion(version, session)
+	if err != nil {
+		return err
+	}
+
+	roomID = m.sessions.UserRoom(join.UserID, roomID)
+	if _, err := session.AddUser(join.UserInfo, roomID); err != nil {
+		return err
+	}
+	m.comeBack(join.UserID)
+	return m.join(ctx, roomID, join, session)
+}
+
+func (m *mediator) join(ctx context.Context, roomID string, join *gameon.Join, session *Session) error {
+	resp, err := m.room.Join(ctx, roomID, join)
+	if err != nil {
+		m.handleRoomError(err, "join", join.UserID, session)
+		return nil
+	}
+
+	m.handleResponse(resp)
+	return nil
 }
 
-func (m *mediator) handleGoodbye(goodbye *gameon.Goodbye, session *Session) {
-	defer session.Close()
+// recover replays to the session the chat and event messages the player missed since its last bookmark.
+// Messages are addressed to the player, as the session may carry other players who didn't miss them.
+func (m *mediator) recover(roomID string, hello *gameon.Hello, session *Session) {
+	missed := m.replay.Missed(hello.UserID, roomID, hello.Bookmark)
+	logrus.Debugf("Replaying %d missed messages to player %s", len(missed), hello.UserID)
 
-	resp, err := m.room.Goodbye(goodbye)
+	for _, msg := range missed {
+		msg.Recipient = hello.UserID
+		sendMessage(&msg, session)
+	}
+}
+
+func (m *mediator) handlePart(ctx context.Context, roomID string, part *gameon.Part, session *Session) {
+	roomID = userRoom(session, part.UserID, roomID)
+	last := session.RemoveUser(part.UserID)
+	if !last {
+		logrus.Debugf("Player %s is still connected over other sessions", part.UserID)
+		return
+	}
+
+	resp, err := m.room.Part(ctx, roomID, part)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing 'goodbye' with room service")
+		logRoomError(err, "part", part.UserID)
 		return
 	}
 
 	m.handleResponse(resp)
 }
 
-func (m *mediator) handleRoomCommand(command *gameon.RoomCommand, session *Session) {
-	resp, err := m.room.Command(command)
+// negotiateVersion validates the protocol version requested by a hello or join message,
+// and records it on the session. A missing version is treated as v1.
+func (m *mediator) negotiateVersion(version int, session *Session) error {
+	if version == 0 {
+		version = 1
+	}
+
+	if !isSupportedVersion(version) {
+		return fmt.Errorf("unsupported protocol version: %d", version)
+	}
+
+	current := session.Version()
+	if current != 0 && current != version {
+		return fmt.Errorf("protocol version %d requested, but version %d already negotiated", version, current)
+	}
+
+	if current == 0 {
+		logrus.Debugf("Negotiated protocol version %d with %s", version, session.Conn.RemoteAddr().String())
+		session.SetVersion(version)
+	}
+
+	return nil
+}
+
+func isSupportedVersion(version int) bool {
+	for _, supported := range SupportedVersions {
+		if supported == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mediator) handleRoomCommand(ctx context.Context, roomID string, command *gameon.RoomCommand, session *Session) {
+	resp, err := m.room.Command(ctx, userRoom(session, command.UserID, roomID), command)
 	if err != nil {
-		logrus.WithError(err).Errorf("Error executing command with room service")
+		m.handleRoomError(err, "command", command.UserID, session)
 		return
 	}
 
 	m.handleResponse(resp)
 }
 
+// userRoom returns the hosted room the player is in, as far as the session knows,
+// falling back on the room the message was sent to.
+func userRoom(session *Session, userID, roomID string) string {
+	if current := session.Room(userID); current != "" {
+		return current
+	}
+	return roomID
+}
+
+// handleRoomError logs a failed room service call, and lets the player know the room didn't respond.
+func (m *mediator) handleRoomError(err error, call, userID string, session *Session) {
+	if err == context.Canceled {
+		logrus.Debugf("'%s' call for player %s canceled, session closed", call, userID)
+		return
+	}
+
+	logRoomError(err, call, userID)
+
+	content := roomErrorMessage
+	if err == errBreakerOpen {
+		content = roomUnavailableMessage
+	}
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, userID, gameon.Event{
+		Type: "event",
+		Content: map[string]string{
+			userID: content,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	sendMessage(msg, session)
+}
+
+func logRoomError(err error, call, userID string) {
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"call":   call,
+		"userId": userID,
+		"kind":   roomErrorKind(err),
+	}).Errorf("Error executing '%s' with room service", call)
+}
+
 func (m *mediator) handleResponse(resp *gameon.MessageCollection) {
 	switch len(resp.Messages) {
 	case 0:
@@ -182,71 +481,92 @@ func (m *mediator) handleResponse(resp *gameon.MessageCollection) {
 		logrus.Debugf("Dispatching %d response message", len(resp.Messages))
 	}
 
-	for _, msg := range resp.Messages {
-		if msg.Recipient == "*" {
-			sendMessage(&msg, m.sessions.GetUserSessions()...)
-		} else {
-			session := m.sessions.GetUserSession(msg.Recipient)
-			if session != nil {
-				sendMessage(&msg, session)
-			}
+	for i := range resp.Messages {
+		// Stamp the message in place, so that any further delivery of it carries the same bookmark
+		msg := &resp.Messages[i]
+		m.replay.Stamp(msg)
+
+		// Recipients may be connected to any mediator replica, so delivery goes through the broadcaster
+		err := m.broadcaster.Publish(msg)
+		if err != nil {
+			logrus.WithError(err).WithFields(messageToFields(msg)).Errorf("Error publishing message")
 		}
 	}
 }
 
-func sendMessage(msg *gameon.Message, sessions ...*Session) {
-	logrus.WithFields(messageToFields(msg)).Debugf("Sending message")
-
-	bytes, err := formatMessage(msg)
-	if err != nil {
-		logrus.WithError(err).Errorf("Error formatting message")
-		return
+// handlePush dispatches the messages received over the room service's push channel.
+// Every mediator replica subscribes to the push channel on its own, so they are only delivered locally.
+func (m *mediator) handlePush(resp *gameon.MessageCollection) {
+	for i := range resp.Messages {
+		msg := &resp.Messages[i]
+		m.replay.Stamp(msg)
+		m.deliver(msg)
 	}
+}
 
-	for _, session := range sessions {
-		err := session.Conn.WriteMessage(websocket.TextMessage, bytes)
-		if err != nil {
-			logrus.WithError(err).Errorf("Error broadcasting message")
-			session.Close()
+// deliver sends a message published by any mediator replica to its recipients connected to this one.
+func (m *mediator) deliver(msg *gameon.Message) {
+	bookmark := m.replay.Record(msg)
+
+	if msg.Recipient == gameon.AllRecipients {
+		for _, session := range m.sessions.GetAllSessions() {
+			users, all := session.UsersIn(msg.Room)
+			if len(users) == 0 {
+				continue
+			}
+
+			if all {
+				sendMessage(msg, session)
+			} else {
+				// The session also carries players in other rooms, who mustn't get the message,
+				// so it is addressed to each player in the room instead
+				for _, userInfo := range users {
+					addressed := *msg
+					addressed.Recipient = userInfo.UserID
+					sendMessage(&addressed, session)
+				}
+			}
+			m.replay.Delivered(msg.Room, bookmark, users)
+		}
+	} else {
+		m.follow(msg)
+
+		sessions := m.sessions.GetUserSessions(msg.Recipient)
+		sendMessage(msg, sessions...)
+		if len(sessions) > 0 {
+			m.replay.Delivered(msg.Room, bookmark, []gameon.UserInfo{{UserID: msg.Recipient}})
 		}
 	}
 }
 
-func formatMessage(msg *gameon.Message) ([]byte, error) {
-	var buf bytes.Buffer
-
-	buf.WriteString(msg.Direction)
-	buf.WriteRune(',')
+// follow keeps track of the player a location message is sent to, as the room service moves it between hosted rooms.
+func (m *mediator) follow(msg *gameon.Message) {
+	if msg.Room == "" || msg.Direction != gameon.DirectionPlayer {
+		return
+	}
 
-	if msg.Recipient != "" {
-		buf.WriteString(msg.Recipient)
-		buf.WriteRune(',')
+	payload, err := gameon.DecodePayload(msg)
+	if err != nil {
+		return
 	}
 
-	buf.Write(msg.Payload)
-	return buf.Bytes(), nil
+	if _, ok := payload.(*gameon.Location); ok {
+		m.sessions.MoveUser(msg.Recipient, msg.Room)
+	}
 }
 
-func parseMessage(data []byte) (*gameon.Message, error) {
-	parts := strings.SplitN(string(data), ",", 3)
+func sendMessage(msg *gameon.Message, sessions ...*Session) {
+	logrus.WithFields(messageToFields(msg)).Debugf("Sending message")
 
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid websocket message format: %s", string(data))
+	bytes, err := gameon.FormatMessage(msg)
+	if err != nil {
+		logrus.WithError(err).Errorf("Error formatting message")
+		return
 	}
 
-	msg := new(gameon.Message)
-	msg.Direction = parts[0]
-
-	if strings.HasPrefix(parts[1], "{") {
-		// case 1: <direction>,{...}
-		msg.Payload = data[len(parts[0])+1:]
-	} else {
-		// case 2: <direction>,<recipient>,{...}
-		msg.Recipient = parts[1]
-		msg.Payload = data[len(parts[0])+len(parts[1])+2:]
+	for _, session := range sessions {
+		session.Send(bytes)
 	}
-
-	return msg, nil
 }
 
 func messageToFields(msg *gameon.Message) logrus.Fields {
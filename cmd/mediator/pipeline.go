@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+	"github.com/gorilla/websocket"
+)
+
+const defaultMaxInflight = 32
+
+const tooFastMessage = "Whoa, slow down! The room can't keep up with you"
+
+// pipelineTask is a decoded message waiting to be dispatched.
+type pipelineTask struct {
+	msg     *gameon.Message
+	payload interface{}
+
+	// slotted is set when the task holds one of the session's slots.
+	slotted bool
+
+	// end is called once the task is done: mediator.end, or mediator.endFarewell for a farewell
+	// accepted while draining.
+	end func()
+}
+
+// pipeline dispatches the messages read from a session without blocking the session's read loop.
+// Messages are dispatched concurrently across players, but in order for each player.
+// The number of messages queued or in progress is bounded, and pending messages are dropped
+// once the session closes, except for goodbyes and parts (see isFarewell).
+type pipeline struct {
+	m       *mediator
+	session *Session
+
+	// slots bounds the number of messages queued or in progress for the session.
+	slots chan struct{}
+
+	// queues holds the pending messages of each player; a player has a worker goroutine
+	// draining its queue for as long as the queue has an entry for it.
+	queues map[string][]pipelineTask
+	mutex  sync.Mutex
+
+	// workers tracks the worker goroutines.
+	workers sync.WaitGroup
+}
+
+func newPipeline(m *mediator, session *Session) *pipeline {
+	return &pipeline{
+		m:       m,
+		session: session,
+		slots:   make(chan struct{}, m.maxInflight),
+		queues:  make(map[string][]pipelineTask),
+	}
+}
+
+// Submit queues a message for dispatching. It never blocks; when the session has too many messages in flight,
+// the message is dropped and the player is told to slow down, unless it's a goodbye or a part.
+func (p *pipeline) Submit(msg *gameon.Message, payload interface{}) {
+	userID := payloadUserID(payload)
+	task := pipelineTask{msg: msg, payload: payload, slotted: true}
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		if !isFarewell(payload) {
+			logrus.WithFields(messageToFields(msg)).Warnf("Too many messages in flight for %s, dropping message", p.session.Conn.RemoteAddr().String())
+			p.tooFast(userID)
+			return
+		}
+		task.slotted = false
+	}
+
+	task.end = p.m.end
+	if !p.m.begin() {
+		if !isFarewell(payload) || !p.m.beginFarewell() {
+			p.release(task)
+			logrus.WithFields(messageToFields(msg)).Warnf("Ignoring websocket message received while draining")
+			return
+		}
+		// Players leaving while draining are still seen off, rather than left lingering in the room
+		task.end = p.m.endFarewell
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	queue, running := p.queues[userID]
+	p.queues[userID] = append(queue, task)
+	if !running {
+		p.workers.Add(1)
+		go p.work(userID)
+	}
+}
+
+// Wait returns once every message submitted was dispatched (or dropped).
+// No message may be submitted while waiting.
+func (p *pipeline) Wait() {
+	p.workers.Wait()
+}
+
+// work dispatches the player's messages one at a time, until the player's queue is empty.
+func (p *pipeline) work(userID string) {
+	defer p.workers.Done()
+	ctx := p.session.Context()
+
+	for {
+		p.mutex.Lock()
+		queue := p.queues[userID]
+		if len(queue) == 0 {
+			delete(p.queues, userID)
+			p.mutex.Unlock()
+			return
+		}
+		task := queue[0]
+		p.queues[userID] = queue[1:]
+		p.mutex.Unlock()
+
+		p.run(ctx, task)
+	}
+}
+
+func (p *pipeline) run(ctx context.Context, task pipelineTask) {
+	defer func() {
+		task.end()
+		p.release(task)
+	}()
+
+	if isFarewell(task.payload) {
+		// The player is leaving whether or not the session is still open, so the room must hear of it:
+		// the call is bounded by the room service timeout rather than by the session
+		ctx = context.Background()
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithFields(messageToFields(task.msg)).Debugf("Session closed, dropping pending message")
+		return
+	}
+
+	err := p.m.dispatch(ctx, task.msg.Recipient, task.payload, p.session)
+
+	if err == errSessionClosed {
+		logrus.WithFields(messageToFields(task.msg)).Debugf("Session closed, dropping pending message")
+		return
+	}
+
+	if err == errUnexpectedPayload {
+		logrus.WithError(err).WithFields(messageToFields(task.msg)).Errorf("Invalid message received")
+		p.session.CloseWithReason(websocket.CloseUnsupportedData, "Unexpected message")
+		return
+	}
+
+	if err != nil {
+		logrus.WithError(err).Errorf("Invalid message received")
+		p.session.CloseWithReason(websocket.ClosePolicyViolation, err.Error())
+	}
+}
+
+func (p *pipeline) release(task pipelineTask) {
+	if task.slotted {
+		<-p.slots
+	}
+}
+
+func (p *pipeline) tooFast(userID string) {
+	if userID == "" {
+		return
+	}
+
+	msg, err := gameon.NewMessage(gameon.DirectionPlayer, userID, gameon.Event{
+		Type: "event",
+		Content: map[string]string{
+			userID: tooFastMessage,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	sendMessage(msg, p.session)
+}
+
+// isFarewell reports whether the payload is a goodbye or a part, which are never dropped:
+// the room would otherwise keep a player who left.
+func isFarewell(payload interface{}) bool {
+	switch payload.(type) {
+	case *gameon.Goodbye, *gameon.Part:
+		return true
+	default:
+		return false
+	}
+}
+
+// payloadUserID returns the ID of the player a room-bound message payload is about.
+func payloadUserID(payload interface{}) string {
+	switch payload := payload.(type) {
+	case *gameon.Hello:
+		return payload.UserID
+	case *gameon.Goodbye:
+		return payload.UserID
+	case *gameon.Join:
+		return payload.UserID
+	case *gameon.Part:
+		return payload.UserID
+	case *gameon.RoomCommand:
+		return payload.UserID
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const (
+	pushMinBackoff = time.Second
+	pushMaxBackoff = 30 * time.Second
+)
+
+// subscribe streams the messages the room service sends on its own (ambient events, timers, NPC speech, ...)
+// from its push channel, and dispatches them like any room service response.
+// The subscription is re-established whenever it drops, resuming after the last message seen,
+// until the context is done.
+func (r *room) subscribe(ctx context.Context, dispatch func(*gameon.MessageCollection)) {
+	var lastEventID string
+	backoff := pushMinBackoff
+
+	for {
+		connectedAt := time.Now()
+		err := r.stream(ctx, &lastEventID, dispatch)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A subscription that lasted a while was healthy, so start backing off all over again
+		if time.Since(connectedAt) > pushMaxBackoff {
+			backoff = pushMinBackoff
+		}
+
+		logrus.WithError(err).Warnf("Room service push channel dropped, reconnecting in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+}
+
+// stream consumes the room service's server-sent events until the stream ends, updating lastEventID as it goes.
+func (r *room) stream(ctx context.Context, lastEventID *string, dispatch func(*gameon.MessageCollection)) error {
+	req, err := http.NewRequest("GET", r.serverURL+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastEventID != "" {
+		req.Header.Set("Last-Event-ID", *lastEventID)
+	}
+	if len(r.identitySecret) > 0 {
+		gameon.SignIdentity(req, r.identitySecret, gameon.UserInfo{}, nil, time.Now())
+	}
+
+	// The stream is long-lived, so the room client's timeout doesn't apply
+	resp, err := r.streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected push channel response: %d %s", resp.StatusCode, resp.Status)
+	}
+
+	logrus.Infof("Subscribed to room service push channel (resuming after '%s')", *lastEventID)
+
+	var id, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// A blank line terminates the event
+			if data != "" {
+				var msg gameon.Message
+				err := json.Unmarshal([]byte(data), &msg)
+				if err != nil {
+					logrus.WithError(err).Errorf("Error parsing push channel message")
+				} else {
+					dispatch(&gameon.MessageCollection{Messages: []gameon.Message{msg}})
+				}
+			}
+			if id != "" {
+				*lastEventID = id
+			}
+			id, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// comment (heartbeat)
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("push channel closed by room service")
+}
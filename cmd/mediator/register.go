@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const defaultMapURL = "https://gameontext.org/map/v1"
+
+// doorDirections lists the Game On door directions, each configured with a ROOM_DOOR_<DIRECTION> variable.
+var doorDirections = []string{"n", "s", "e", "w", "u", "d"}
+
+// registerRoom creates or updates the room's site on the Game On map, based on the environment configuration.
+func registerRoom() error {
+	ownerID := os.Getenv("GAMEON_ID")
+	secret := os.Getenv("GAMEON_SECRET")
+	if ownerID == "" || secret == "" {
+		return fmt.Errorf("registration requires GAMEON_ID and GAMEON_SECRET to be set")
+	}
+
+	mapURL := os.Getenv("GAMEON_MAP_URL")
+	if mapURL == "" {
+		mapURL = defaultMapURL
+	}
+
+	info, err := roomInfoFromEnv()
+	if err != nil {
+		return err
+	}
+
+	client := gameon.NewMapClient(mapURL, ownerID, []byte(secret))
+	site, err := client.Register(info)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Room %s registered with the Game On map as site %s", info.Name, site.ID)
+	return nil
+}
+
+func roomInfoFromEnv() (*gameon.RoomInfo, error) {
+	name := os.Getenv("ROOM_NAME")
+	if name == "" {
+		name = os.Getenv("ROOM_ID")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("registration requires ROOM_NAME or ROOM_ID to be set")
+	}
+
+	target := os.Getenv("ROOM_WEBSOCKET_URL")
+	if target == "" {
+		return nil, fmt.Errorf("registration requires ROOM_WEBSOCKET_URL to be set")
+	}
+
+	doors := make(map[string]string)
+	for _, direction := range doorDirections {
+		if door := os.Getenv("ROOM_DOOR_" + strings.ToUpper(direction)); door != "" {
+			doors[direction] = door
+		}
+	}
+
+	return &gameon.RoomInfo{
+		Name:        name,
+		FullName:    os.Getenv("ROOM_FULL_NAME"),
+		Description: os.Getenv("ROOM_DESCRIPTION"),
+		Doors:       doors,
+		ConnectionDetails: &gameon.ConnectionDetails{
+			Type:   "websocket",
+			Target: target,
+			Token:  os.Getenv("ROOM_WEBSOCKET_TOKEN"),
+		},
+	}, nil
+}
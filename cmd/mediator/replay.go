@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const defaultReplayBufferSize = 256
+
+type replayEntry struct {
+	bookmark int64
+	msg      gameon.Message
+}
+
+// replayBuffer stamps outbound chat and event messages with monotonically increasing bookmarks,
+// and keeps the most recent ones of each room around, so that recovering players can catch up on what they missed.
+type replayBuffer struct {
+	// rings maps room IDs to the messages of the room, those not saying which room they come from
+	// being keyed by an empty ID. Each ring holds up to size entries, so that a busy room doesn't crowd
+	// the others out.
+	rings map[string]*replayRing
+	size  int
+
+	// last is the highest bookmark assigned or recorded.
+	last int64
+
+	mutex sync.Mutex
+}
+
+// replayRing holds the most recent messages of a room, in the order they were recorded.
+type replayRing struct {
+	// entries is a ring buffer, the oldest entry at index start.
+	entries []replayEntry
+	start   int
+	count   int
+
+	// seen maps user IDs to the last bookmark of the room delivered to the player.
+	// Players are forgotten when they leave, or once their last bookmark left the ring (see sweep).
+	seen map[string]int64
+
+	// recorded counts the entries recorded since seen was last swept.
+	recorded int
+}
+
+func newReplayBuffer() *replayBuffer {
+	return &replayBuffer{
+		rings: make(map[string]*replayRing),
+		size:  env.PositiveInt("REPLAY_BUFFER_SIZE", defaultReplayBufferSize),
+	}
+}
+
+// ring returns the ring of the room, creating it on first use. The caller must hold the lock.
+func (b *replayBuffer) ring(roomID string) *replayRing {
+	ring, ok := b.rings[roomID]
+	if !ok {
+		ring = &replayRing{entries: make([]replayEntry, b.size), seen: make(map[string]int64)}
+		b.rings[roomID] = ring
+	}
+	return ring
+}
+
+// Stamp assigns the next bookmark to a chat or event message. Other messages are left untouched.
+//
+// Messages may be stamped by any mediator replica, so bookmarks are based on the clock (in microseconds),
+// while still increasing monotonically within each replica. Replicas also move their bookmarks past those
+// of the messages they record, so that bookmarks stay roughly ordered across replicas.
+func (b *replayBuffer) Stamp(msg *gameon.Message) {
+	payload := bookmarkable(msg)
+	if payload == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bookmark := b.last + 1
+	if now := time.Now().UnixNano() / int64(time.Microsecond); now > bookmark {
+		bookmark = now
+	}
+
+	switch payload := payload.(type) {
+	case *gameon.Chat:
+		payload.Bookmark = strconv.FormatInt(bookmark, 10)
+	case *gameon.Event:
+		payload.Bookmark = strconv.FormatInt(bookmark, 10)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	b.last = bookmark
+	msg.Payload = payloadBytes
+}
+
+// Record keeps a stamped message around for replay, and returns its bookmark (or zero, if it has none).
+func (b *replayBuffer) Record(msg *gameon.Message) int64 {
+	var bookmark string
+	switch payload := bookmarkable(msg).(type) {
+	case *gameon.Chat:
+		bookmark = payload.Bookmark
+	case *gameon.Event:
+		bookmark = payload.Bookmark
+	}
+
+	seq, err := strconv.ParseInt(bookmark, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if seq > b.last {
+		b.last = seq
+	}
+	b.ring(msg.Room).record(replayEntry{bookmark: seq, msg: *msg})
+
+	return seq
+}
+
+// record adds the entry to the ring, in place of the oldest one once the ring is full.
+func (r *replayRing) record(entry replayEntry) {
+	end := (r.start + r.count) % len(r.entries)
+	r.entries[end] = entry
+	if r.count < len(r.entries) {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % len(r.entries)
+	}
+
+	r.recorded++
+	if r.recorded >= len(r.entries) {
+		r.sweep()
+	}
+}
+
+// sweep forgets the players whose last bookmark is older than any message in the ring, so that seen doesn't grow
+// with every player ever delivered a message. There's no telling what those players missed anyway.
+// It runs once every time the ring turns over.
+func (r *replayRing) sweep() {
+	r.recorded = 0
+	if r.count < len(r.entries) {
+		return
+	}
+
+	oldest := r.entries[r.start].bookmark
+	for userID, bookmark := range r.seen {
+		if bookmark < oldest {
+			delete(r.seen, userID)
+		}
+	}
+}
+
+// Forget drops what's known about the player, who left without meaning to recover.
+func (b *replayBuffer) Forget(userID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, ring := range b.rings {
+		delete(ring.seen, userID)
+	}
+}
+
+// bookmarkable returns the decoded payload of chat and event messages, or nil for other messages.
+func bookmarkable(msg *gameon.Message) interface{} {
+	if msg.Direction != gameon.DirectionPlayer {
+		return nil
+	}
+
+	payload, err := gameon.DecodePayload(msg)
+	if err != nil {
+		return nil
+	}
+
+	switch payload.(type) {
+	case *gameon.Chat, *gameon.Event:
+		return payload
+	default:
+		return nil
+	}
+}
+
+// Delivered records that the message of the given room with the given bookmark was delivered to the players.
+func (b *replayBuffer) Delivered(roomID string, bookmark int64, users []gameon.UserInfo) {
+	if bookmark == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ring := b.ring(roomID)
+	for _, userInfo := range users {
+		if ring.seen[userInfo.UserID] < bookmark {
+			ring.seen[userInfo.UserID] = bookmark
+		}
+	}
+}
+
+// Missed returns the buffered messages addressed to the player (directly, or to everyone in the given room)
+// after the given bookmark, in the order of their bookmarks. If the bookmark is empty or invalid,
+// the last bookmark delivered to the player is used instead.
+func (b *replayBuffer) Missed(userID, roomID, bookmark string) []gameon.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	since, err := strconv.ParseInt(bookmark, 10, 64)
+	if err != nil {
+		var ok bool
+		since, ok = b.lastSeen(userID)
+		if !ok {
+			// Nothing is known about the player, so there's no telling what was missed
+			return nil
+		}
+	}
+
+	// Messages addressed to the player may come from any room
+	var missed []replayEntry
+	for _, ring := range b.rings {
+		for i := 0; i < ring.count; i++ {
+			entry := ring.entries[(ring.start+i)%len(ring.entries)]
+			if entry.bookmark <= since {
+				continue
+			}
+			if entry.msg.Recipient == userID || entry.msg.Recipient == gameon.AllRecipients && inRoom(&entry.msg, roomID) {
+				missed = append(missed, entry)
+			}
+		}
+	}
+	sort.Stable(byBookmark(missed))
+
+	msgs := make([]gameon.Message, len(missed))
+	for i, entry := range missed {
+		msgs[i] = entry.msg
+	}
+	return msgs
+}
+
+// lastSeen returns the last bookmark delivered to the player, whichever the room, and whether there's any.
+// The caller must hold the lock.
+func (b *replayBuffer) lastSeen(userID string) (int64, bool) {
+	var last int64
+	var found bool
+	for _, ring := range b.rings {
+		if bookmark, ok := ring.seen[userID]; ok && (!found || bookmark > last) {
+			last, found = bookmark, true
+		}
+	}
+	return last, found
+}
+
+// inRoom reports whether the message comes from the given room. Messages not saying which room they come from,
+// and rooms not known, match any room.
+func inRoom(msg *gameon.Message, roomID string) bool {
+	return msg.Room == "" || roomID == "" || msg.Room == roomID
+}
+
+type byBookmark []replayEntry
+
+func (e byBookmark) Len() int           { return len(e) }
+func (e byBookmark) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byBookmark) Less(i, j int) bool { return e[i].bookmark < e[j].bookmark }
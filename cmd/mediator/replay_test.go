@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func TestReplayRingPerRoom(t *testing.T) {
+	b := &replayBuffer{rings: make(map[string]*replayRing), size: 2}
+	alice := gameon.UserInfo{UserID: "dummy.alice", Username: "alice"}
+
+	record := func(roomID, content string) int64 {
+		msg := newTestMessage(t, gameon.AllRecipients, roomID, content)
+		b.Stamp(msg)
+		return b.Record(msg)
+	}
+	contents := func(msgs []gameon.Message) []string {
+		var contents []string
+		for _, msg := range msgs {
+			payload, err := gameon.DecodePayload(&msg)
+			if err != nil {
+				t.Fatalf("DecodePayload: %v", err)
+			}
+			contents = append(contents, payload.(*gameon.Event).Content["*"])
+		}
+		return contents
+	}
+
+	seen := record("cellar", "cellar 1")
+	b.Delivered("cellar", seen, []gameon.UserInfo{alice})
+	record("cellar", "cellar 2")
+	for i := 1; i <= 3; i++ {
+		record("lounge", "lounge "+strconv.Itoa(i))
+	}
+
+	// The busy lounge only keeps its last messages, without crowding out the cellar's
+	tests := []struct {
+		roomID   string
+		bookmark string
+		missed   []string
+	}{
+		{"cellar", "", []string{"cellar 2"}},
+		{"cellar", "0", []string{"cellar 1", "cellar 2"}},
+		{"lounge", "0", []string{"lounge 2", "lounge 3"}},
+		{"", strconv.FormatInt(seen, 10), []string{"cellar 2", "lounge 2", "lounge 3"}},
+	}
+
+	for _, test := range tests {
+		if missed := contents(b.Missed(alice.UserID, test.roomID, test.bookmark)); !reflect.DeepEqual(missed, test.missed) {
+			t.Errorf("Missed(%s, %q) = %q, want %q", test.roomID, test.bookmark, missed, test.missed)
+		}
+	}
+
+	b.Forget(alice.UserID)
+	if missed := b.Missed(alice.UserID, "cellar", ""); len(missed) != 0 {
+		t.Errorf("Missed() after Forget() = %d messages, want none", len(missed))
+	}
+}
@@ -2,20 +2,45 @@ package main
 
 import (
 	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
-	"time"
-
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
 	"github.com/gameontext/a8-room/pkg/gameon"
 )
 
+const (
+	defaultRoomTimeout         = 5 * time.Second
+	defaultRoomRetries         = 2
+	defaultRoomRetryBackoff    = 100 * time.Millisecond
+	defaultRoomRetryMaxBackoff = time.Second
+	defaultBreakerThreshold    = 5
+	defaultBreakerCooldown     = 30 * time.Second
+)
+
 type room struct {
-	httpClient *http.Client
-	serverURL  string
+	httpClient     *http.Client
+	streamClient   *http.Client
+	serverURL      string
+	identitySecret []byte
+
+	// retries is the number of additional attempts made for a failed call,
+	// waiting a jittered exponential backoff (starting at retryBackoff, up to retryMaxBackoff) in between.
+	retries         int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+
+	breaker *breaker
 }
 
 func newRoom() *room {
@@ -24,41 +49,125 @@ func newRoom() *room {
 		serverURL = "http://localhost:6379/room"
 	}
 
+	identitySecret := os.Getenv("IDENTITY_SECRET")
+	if identitySecret == "" {
+		logrus.Warnf("IDENTITY_SECRET is not set, user identity headers will not be signed")
+	}
+
 	return &room{
-		httpClient: &http.Client{Timeout: 5 * time.Second},
-		serverURL:  serverURL,
+		httpClient:      &http.Client{Timeout: env.PositiveDuration("ROOM_TIMEOUT", defaultRoomTimeout)},
+		streamClient:    &http.Client{},
+		serverURL:       serverURL,
+		identitySecret:  []byte(identitySecret),
+		retries:         env.Int("ROOM_RETRIES", defaultRoomRetries),
+		retryBackoff:    env.Duration("ROOM_RETRY_BACKOFF", defaultRoomRetryBackoff),
+		retryMaxBackoff: env.Duration("ROOM_RETRY_MAX_BACKOFF", defaultRoomRetryMaxBackoff),
+		breaker: newBreaker(
+			env.PositiveInt("ROOM_BREAKER_THRESHOLD", defaultBreakerThreshold),
+			env.Duration("ROOM_BREAKER_COOLDOWN", defaultBreakerCooldown)),
 	}
 }
 
-func (r *room) Hello(hello *gameon.Hello) (*gameon.MessageCollection, error) {
-	return r.doRequest("/hello", hello.UserInfo, hello)
+// Hello, Goodbye, Join and Part are idempotent as far as the room's state goes, so they are retried as is.
+// Commands aren't, so they rely on the idempotency key sent with every call (and reused across its retries)
+// to let the room service detect duplicates.
+//
+// Every call is meant for one of the rooms hosted by the room service, identified by roomID.
+
+func (r *room) Hello(ctx context.Context, roomID string, hello *gameon.Hello) (*gameon.MessageCollection, error) {
+	return r.doRequest(ctx, "/hello", roomID, hello.UserInfo, hello)
 }
 
-func (r *room) Goodbye(goodbye *gameon.Goodbye) (*gameon.MessageCollection, error) {
-	return r.doRequest("/goodbye", goodbye.UserInfo, goodbye)
+func (r *room) Goodbye(ctx context.Context, roomID string, goodbye *gameon.Goodbye) (*gameon.MessageCollection, error) {
+	return r.doRequest(ctx, "/goodbye", roomID, goodbye.UserInfo, goodbye)
 }
 
-func (r *room) Command(command *gameon.RoomCommand) (*gameon.MessageCollection, error) {
-	return r.doRequest("/room", command.UserInfo, command)
+func (r *room) Join(ctx context.Context, roomID string, join *gameon.Join) (*gameon.MessageCollection, error) {
+	return r.doRequest(ctx, "/join", roomID, join.UserInfo, join)
 }
 
-func (r *room) doRequest(path string, userInfo gameon.UserInfo, body interface{}) (*gameon.MessageCollection, error) {
-	url := r.serverURL + path
+func (r *room) Part(ctx context.Context, roomID string, part *gameon.Part) (*gameon.MessageCollection, error) {
+	return r.doRequest(ctx, "/part", roomID, part.UserInfo, part)
+}
+
+func (r *room) Command(ctx context.Context, roomID string, command *gameon.RoomCommand) (*gameon.MessageCollection, error) {
+	return r.doRequest(ctx, "/room", roomID, command.UserInfo, command)
+}
+
+func (r *room) doRequest(ctx context.Context, path, roomID string, userInfo gameon.UserInfo, body interface{}) (*gameon.MessageCollection, error) {
+	if !r.breaker.Allow() {
+		return nil, errBreakerOpen
+	}
 
 	reqBytes, err := json.Marshal(body)
 	if err != nil {
+		r.breaker.Release()
 		return nil, err
 	}
-	reqBuf := bytes.NewBuffer(reqBytes)
+
+	idempotencyKey := newIdempotencyKey()
+
+	var msgs *gameon.MessageCollection
+	for attempt := 0; ; attempt++ {
+		msgs, err = r.doAttempt(ctx, path, roomID, userInfo, reqBytes, idempotencyKey)
+		if err == nil || !isRetryable(err) || attempt >= r.retries || ctx.Err() != nil {
+			break
+		}
+
+		backoff := r.backoff(attempt)
+		logrus.WithError(err).Warnf("Room service %s request failed (attempt %d of %d), retrying in %s", path, attempt+1, r.retries+1, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+	}
+
+	if ctx.Err() != nil {
+		r.breaker.Release()
+		return nil, ctx.Err()
+	}
+
+	// Rejected requests mean the room service is up and running, so only retryable failures trip the breaker
+	r.breaker.Report(err == nil || !isRetryable(err))
+
+	return msgs, err
+}
+
+// backoff returns a random duration between zero and the exponential backoff for the attempt ("full jitter").
+func (r *room) backoff(attempt int) time.Duration {
+	backoff := r.retryBackoff << uint(attempt)
+	if backoff <= 0 || backoff > r.retryMaxBackoff {
+		backoff = r.retryMaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+func (r *room) doAttempt(ctx context.Context, path, roomID string, userInfo gameon.UserInfo, reqBytes []byte, idempotencyKey string) (*gameon.MessageCollection, error) {
+	url := r.serverURL + path
+	reqBuf := bytes.NewReader(reqBytes)
 
 	req, err := http.NewRequest("POST", url, reqBuf)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set(gameon.UserIDHeader, userInfo.UserID)
-	req.Header.Set(gameon.UsernameHeader, userInfo.Username)
+	req.Header.Set(gameon.IdempotencyKeyHeader, idempotencyKey)
+	if roomID != "" {
+		req.Header.Set(gameon.RoomIDHeader, roomID)
+	}
+	if len(r.identitySecret) > 0 {
+		gameon.SignIdentity(req, r.identitySecret, userInfo, reqBytes, time.Now())
+	} else {
+		req.Header.Set(gameon.UserIDHeader, userInfo.UserID)
+		req.Header.Set(gameon.UsernameHeader, userInfo.Username)
+	}
 
 	logrus.Debugf("Executing HTTP request: %s %s (%d bytes)", req.Method, req.RequestURI, req.ContentLength)
 
@@ -75,11 +184,103 @@ func (r *room) doRequest(path string, userInfo gameon.UserInfo, body interface{}
 		return nil, err
 	}
 
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, &roomServiceError{Path: path, StatusCode: resp.StatusCode, Body: string(respBytes)}
+	case resp.StatusCode >= 400:
+		return nil, &roomRequestError{Path: path, StatusCode: resp.StatusCode, Body: string(respBytes)}
+	}
+
 	var msgs gameon.MessageCollection
 	err = json.Unmarshal(respBytes, &msgs)
 	if err != nil {
-		return nil, err
+		return nil, &roomResponseError{Path: path, Err: err}
+	}
+
+	// A room service hosting a single room may not say which room its messages come from
+	for i := range msgs.Messages {
+		if msgs.Messages[i].Room == "" {
+			msgs.Messages[i].Room = roomID
+		}
 	}
 
 	return &msgs, nil
 }
+
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	_, err := cryptorand.Read(key)
+	if err != nil {
+		// Fall back to a key that is unique for this process, which is good enough to tell retries apart
+		return fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+	}
+
+	return hex.EncodeToString(key)
+}
+
+// isRetryable reports whether a failed call may succeed if attempted again.
+func isRetryable(err error) bool {
+	switch roomErrorKind(err) {
+	case "service", "timeout", "network":
+		return true
+	default:
+		return false
+	}
+}
+
+// roomRequestError is returned when the room service rejects a request (4xx status code).
+type roomRequestError struct {
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *roomRequestError) Error() string {
+	return fmt.Sprintf("room service rejected %s request with %d %s: %s", e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// roomServiceError is returned when the room service fails handling a request (5xx status code).
+type roomServiceError struct {
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *roomServiceError) Error() string {
+	return fmt.Sprintf("room service failed %s request with %d %s: %s", e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// roomResponseError is returned when the room service response can't be decoded.
+type roomResponseError struct {
+	Path string
+	Err  error
+}
+
+func (e *roomResponseError) Error() string {
+	return fmt.Sprintf("invalid room service response to %s request: %v", e.Path, e.Err)
+}
+
+// roomErrorKind classifies a room service call error, so that failures can be told apart in logs.
+func roomErrorKind(err error) string {
+	if err == errBreakerOpen {
+		return "breaker"
+	}
+
+	switch err := err.(type) {
+	case *roomRequestError:
+		return "request"
+	case *roomServiceError:
+		return "service"
+	case *roomResponseError:
+		return "response"
+	case nil:
+		return "none"
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	default:
+		return "unknown"
+	}
+}
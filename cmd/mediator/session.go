@@ -1,27 +1,128 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	defaultQueueSize    = 64
+	defaultWriteTimeout = 10 * time.Second
+)
+
+// errSessionClosed is returned when attaching a player to a session that closed in the meantime.
+var errSessionClosed = errors.New("session closed")
+
+// slowConsumerPolicy determines what happens when a session's outbound queue is full.
+type slowConsumerPolicy string
+
+const (
+	// dropOldest discards the oldest queued message to make room for the new one.
+	dropOldest slowConsumerPolicy = "drop-oldest"
+
+	// disconnect closes the session.
+	disconnect slowConsumerPolicy = "disconnect"
+)
+
+// sessionConfig holds the outbound queue settings shared by all sessions.
+type sessionConfig struct {
+	queueSize    int
+	writeTimeout time.Duration
+	policy       slowConsumerPolicy
+}
+
+func newSessionConfig() sessionConfig {
+	config := sessionConfig{
+		queueSize:    env.PositiveInt("SESSION_QUEUE_SIZE", defaultQueueSize),
+		writeTimeout: env.PositiveDuration("SESSION_WRITE_TIMEOUT", defaultWriteTimeout),
+		policy:       dropOldest,
+	}
+
+	if value := strings.ToLower(os.Getenv("SLOW_CONSUMER_POLICY")); value != "" {
+		switch policy := slowConsumerPolicy(value); policy {
+		case dropOldest, disconnect:
+			config.policy = policy
+		default:
+			panic(fmt.Sprintf("unsupported slow consumer policy: %s", value))
+		}
+	}
+
+	return config
+}
+
 type Session struct {
-	Conn   *websocket.Conn
-	UserID string
+	// lastActivity holds the time (in Unix nanoseconds) the last message was received from the connection.
+	// It is accessed atomically, and kept first for 64-bit alignment.
+	lastActivity int64
+
+	Conn *websocket.Conn
+
+	// version is the Game On protocol version negotiated for the connection.
+	// It is zero until the first hello or join message is received.
+	version int
+
+	// users maps the IDs of the players carried over the connection to their usernames and current rooms.
+	// Protocol v1 connections carry a single player, while v2 connections may carry several.
+	users map[string]sessionUser
+
+	// departed holds the players the session was the last one of when it closed, along with where they were,
+	// so that a goodbye or part still pending for them reaches their room.
+	departed map[string]sessionUser
+
+	// outbound queues the frames to be written to the connection.
+	// It is drained by a single writer goroutine, as websocket connections don't support concurrent writers.
+	outbound chan []byte
 
 	done    chan struct{}
+	flushed chan struct{}
 	manager *SessionManager
+
+	// ctx is canceled once the session is closed, to abandon the work pending on its behalf.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// closeCode and closeText are sent in the close frame, once the session is closed.
+	closeCode int
+	closeText string
+}
+
+// sessionUser is a player carried over a session.
+type sessionUser struct {
+	username string
+
+	// roomID is the hosted room the player is in. It starts as the room the player entered through,
+	// and follows the player as the room service moves it between hosted rooms.
+	roomID string
 }
 
 type SessionManager struct {
-	sessions map[string]*Session
-	mutex    sync.RWMutex
+	// sessions maps each user ID to the set of sessions the player is connected over.
+	// A player may have several sessions at once, e.g. two browser tabs, or a reconnect before the old socket died.
+	sessions map[string]map[*Session]struct{}
+
+	// open holds every session not closed yet, whether or not it carries players.
+	open map[*Session]struct{}
+
+	config sessionConfig
+	mutex  sync.RWMutex
 }
 
 func newSessions() *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		sessions: make(map[string]map[*Session]struct{}),
+		open:     make(map[*Session]struct{}),
+		config:   newSessionConfig(),
 	}
 }
 
@@ -30,59 +131,354 @@ func (sm *SessionManager) NewSession(conn *websocket.Conn) *Session {
 	defer sm.mutex.Unlock()
 
 	session := &Session{
-		Conn:    conn,
-		done:    make(chan struct{}),
-		manager: sm,
+		Conn:     conn,
+		users:    make(map[string]sessionUser),
+		departed: make(map[string]sessionUser),
+		outbound: make(chan []byte, sm.config.queueSize),
+		done:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+		manager:  sm,
 	}
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+	session.Touch()
+	sm.open[session] = struct{}{}
+	go session.writeLoop()
 
 	return session
 }
 
-func (sm *SessionManager) GetUserSessions() []*Session {
+// GetAllSessions returns every session carrying at least one player.
+func (sm *SessionManager) GetAllSessions() []*Session {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
+	// A v2 session carrying several players must only be returned once
+	seen := make(map[*Session]struct{}, len(sm.sessions))
 	sessions := make([]*Session, 0, len(sm.sessions))
-	for _, session := range sm.sessions {
+	for _, userSessions := range sm.sessions {
+		for session := range userSessions {
+			if _, ok := seen[session]; ok {
+				continue
+			}
+			seen[session] = struct{}{}
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions
+}
+
+// GetOpenSessions returns every session not closed yet, including sessions not carrying any player.
+func (sm *SessionManager) GetOpenSessions() []*Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.open))
+	for session := range sm.open {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// GetUserSessions returns every session the given player is connected over.
+func (sm *SessionManager) GetUserSessions(userID string) []*Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.sessions[userID]))
+	for session := range sm.sessions[userID] {
 		sessions = append(sessions, session)
 	}
 
 	return sessions
 }
 
-func (sm *SessionManager) GetUserSession(userID string) *Session {
+// MoveUser records that the player moved to another room, on every session the player is connected over.
+func (sm *SessionManager) MoveUser(userID, roomID string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for session := range sm.sessions[userID] {
+		user := session.users[userID]
+		user.roomID = roomID
+		session.users[userID] = user
+	}
+}
+
+// UserRoom returns the room the player is in over its other sessions, or the given room if not connected elsewhere.
+func (sm *SessionManager) UserRoom(userID, roomID string) string {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
-	return sm.sessions[userID]
+	for session := range sm.sessions[userID] {
+		if current := session.users[userID].roomID; current != "" {
+			return current
+		}
+	}
+	return roomID
+}
+
+// add registers the session for the player, and reports whether it is the player's first session.
+// The caller must hold the manager's lock.
+func (sm *SessionManager) add(userID string, session *Session) bool {
+	userSessions, ok := sm.sessions[userID]
+	if !ok {
+		userSessions = make(map[*Session]struct{})
+		sm.sessions[userID] = userSessions
+	}
+
+	userSessions[session] = struct{}{}
+	return len(userSessions) == 1
+}
+
+// remove unregisters the session for the player, and reports whether it was the player's last session.
+// The caller must hold the manager's lock.
+func (sm *SessionManager) remove(userID string, session *Session) bool {
+	userSessions, ok := sm.sessions[userID]
+	if !ok {
+		return false
+	}
+
+	if _, ok := userSessions[session]; !ok {
+		return false
+	}
+
+	delete(userSessions, session)
+	if len(userSessions) > 0 {
+		return false
+	}
+
+	delete(sm.sessions, userID)
+	return true
 }
 
 func (s *Session) Closed() <-chan struct{} {
 	return s.done
 }
 
+// Context returns a context canceled once the session is closed.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Flushed returns a channel closed once the session is closed, and its queued frames were written out.
+// The connection may be safely closed at that point.
+func (s *Session) Flushed() <-chan struct{} {
+	return s.flushed
+}
+
+// Send queues a frame to be written to the connection.
+// When the queue is full, the configured slow consumer policy applies.
+func (s *Session) Send(frame []byte) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case s.outbound <- frame:
+			return
+		default:
+		}
+
+		switch s.manager.config.policy {
+		case disconnect:
+			logrus.Warnf("Outbound queue full for %s, disconnecting", s.Conn.RemoteAddr().String())
+			s.CloseWithReason(websocket.ClosePolicyViolation, "Too slow")
+			return
+		default:
+			select {
+			case <-s.outbound:
+				logrus.Warnf("Outbound queue full for %s, dropped oldest message", s.Conn.RemoteAddr().String())
+			default:
+			}
+		}
+	}
+}
+
+func (s *Session) writeLoop() {
+	defer close(s.flushed)
+
+	for {
+		select {
+		case frame := <-s.outbound:
+			if !s.write(frame) {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush writes out whatever is still queued (e.g., a farewell), followed by a close frame.
+func (s *Session) flush() {
+	for {
+		select {
+		case frame := <-s.outbound:
+			if !s.write(frame) {
+				return
+			}
+		default:
+			deadline := time.Now().Add(s.manager.config.writeTimeout)
+			s.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(s.closeCode, s.closeText), deadline)
+			return
+		}
+	}
+}
+
+func (s *Session) write(frame []byte) bool {
+	s.Conn.SetWriteDeadline(time.Now().Add(s.manager.config.writeTimeout))
+
+	err := s.Conn.WriteMessage(websocket.TextMessage, frame)
+	if err != nil {
+		logrus.WithError(err).Errorf("Error writing websocket message to %s", s.Conn.RemoteAddr().String())
+		return false
+	}
+
+	return true
+}
+
+// Close closes the session with a normal closure code.
 func (s *Session) Close() error {
+	return s.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithReason closes the session, sending the given RFC 6455 close code and reason to the peer.
+// Only the first close of a session takes effect.
+func (s *Session) CloseWithReason(code int, reason string) error {
 	s.manager.mutex.Lock()
 	defer s.manager.mutex.Unlock()
 
-	if s.UserID != "" {
-		delete(s.manager.sessions, s.UserID)
+	for userID, user := range s.users {
+		if s.manager.remove(userID, s) {
+			s.departed[userID] = user
+		}
 	}
+	s.users = make(map[string]sessionUser)
+	delete(s.manager.open, s)
 
 	select {
-	case <- s.done:
+	case <-s.done:
 		// already closed
 	default:
+		s.closeCode = code
+		s.closeText = reason
 		close(s.done)
+		s.cancel()
 	}
 
 	return nil
 }
 
-func (s *Session) SetUserID(userID string) {
+// Touch records activity on the session, postponing its idle timeout.
+func (s *Session) Touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// IdleFor returns how long the session has been idle.
+func (s *Session) IdleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+}
+
+func (s *Session) SetVersion(version int) {
 	s.manager.mutex.Lock()
 	defer s.manager.mutex.Unlock()
 
-	s.UserID = userID
-	s.manager.sessions[s.UserID] = s
+	s.version = version
+}
+
+func (s *Session) Version() int {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	return s.version
+}
+
+// AddUser attaches the player to the session, in the given room,
+// and reports whether it is the player's first session.
+// It returns errSessionClosed if the session is closed, as the player would then never be seen off.
+func (s *Session) AddUser(userInfo gameon.UserInfo, roomID string) (bool, error) {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return false, errSessionClosed
+	default:
+	}
+
+	s.users[userInfo.UserID] = sessionUser{username: userInfo.Username, roomID: roomID}
+	return s.manager.add(userInfo.UserID, s), nil
+}
+
+// Users returns the players currently carried over the session.
+func (s *Session) Users() []gameon.UserInfo {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	users := make([]gameon.UserInfo, 0, len(s.users))
+	for userID, user := range s.users {
+		users = append(users, gameon.UserInfo{UserID: userID, Username: user.username})
+	}
+
+	return users
+}
+
+// UsersIn returns the players carried over the session that are in the given room,
+// and whether they are all the players carried over the session.
+// An empty room ID stands for any room.
+func (s *Session) UsersIn(roomID string) ([]gameon.UserInfo, bool) {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	users := make([]gameon.UserInfo, 0, len(s.users))
+	for userID, user := range s.users {
+		if roomID == "" || user.roomID == roomID {
+			users = append(users, gameon.UserInfo{UserID: userID, Username: user.username})
+		}
+	}
+
+	return users, len(users) == len(s.users)
+}
+
+// Room returns the room the player is in (or was in, if it departed with the session closing),
+// or an empty string if the player isn't carried over the session.
+func (s *Session) Room(userID string) string {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	if user, ok := s.users[userID]; ok {
+		return user.roomID
+	}
+	return s.departed[userID].roomID
+}
+
+// Departed returns the players the session was the last one of when it closed, and who didn't leave since.
+func (s *Session) Departed() []gameon.UserInfo {
+	s.manager.mutex.RLock()
+	defer s.manager.mutex.RUnlock()
+
+	users := make([]gameon.UserInfo, 0, len(s.departed))
+	for userID, user := range s.departed {
+		users = append(users, gameon.UserInfo{UserID: userID, Username: user.username})
+	}
+
+	return users
+}
+
+// RemoveUser detaches the player from the session, and reports whether it was the player's last session.
+func (s *Session) RemoveUser(userID string) bool {
+	s.manager.mutex.Lock()
+	defer s.manager.mutex.Unlock()
+
+	if _, ok := s.departed[userID]; ok {
+		// The player may have reconnected over another session in the meantime
+		delete(s.departed, userID)
+		return len(s.manager.sessions[userID]) == 0
+	}
+
+	delete(s.users, userID)
+	return s.manager.remove(userID, s)
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func TestAddUserAfterClose(t *testing.T) {
+	r := newTestReplica(newLocalBus())
+	defer r.Close()
+
+	alice := gameon.UserInfo{UserID: "dummy.alice", Username: "alice"}
+	conn, session := r.connect(t, "lounge")
+	defer conn.Close()
+
+	session.Close()
+	if first, err := session.AddUser(alice, "lounge"); first || err != errSessionClosed {
+		t.Errorf("AddUser() after Close() = %v, %v, want false, %v", first, err, errSessionClosed)
+	}
+
+	if users := session.Users(); len(users) != 0 {
+		t.Errorf("Users() = %v, want none", users)
+	}
+	if sessions := r.m.sessions.GetUserSessions(alice.UserID); len(sessions) != 0 {
+		t.Errorf("GetUserSessions() = %v, want none", sessions)
+	}
+}
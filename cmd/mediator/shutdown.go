@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+	"github.com/gorilla/websocket"
+)
+
+const defaultShutdownGracePeriod = 10 * time.Second
+
+const restartingMessage = "The room is restarting, you'll be back in a moment..."
+
+// begin registers an in-flight room service call, unless the mediator is draining.
+// Every successful call must be matched by a call to end.
+func (m *mediator) begin() bool {
+	m.drainMutex.Lock()
+	defer m.drainMutex.Unlock()
+
+	if m.draining {
+		return false
+	}
+
+	m.inflight.Add(1)
+	return true
+}
+
+func (m *mediator) end() {
+	m.inflight.Done()
+}
+
+// beginFarewell registers a goodbye or part received while draining, unless the sessions were all closed.
+// Every successful call must be matched by a call to endFarewell.
+func (m *mediator) beginFarewell() bool {
+	m.drainMutex.Lock()
+	defer m.drainMutex.Unlock()
+
+	if m.closing {
+		return false
+	}
+
+	m.farewells.Add(1)
+	return true
+}
+
+func (m *mediator) endFarewell() {
+	m.farewells.Done()
+}
+
+func (m *mediator) isDraining() bool {
+	m.drainMutex.Lock()
+	defer m.drainMutex.Unlock()
+
+	return m.draining
+}
+
+// Shutdown drains the mediator: new websocket upgrades and commands are refused, in-flight room service calls
+// are given a chance to complete, and then every player is told the room is restarting, before its session is
+// closed with a going-away code. Goodbyes and parts received meanwhile still reach the room.
+// Shutdown returns once all sessions are flushed, or when the context is done.
+func (m *mediator) Shutdown(ctx context.Context) error {
+	m.drainMutex.Lock()
+	m.draining = true
+	m.drainMutex.Unlock()
+
+	logrus.Infof("Draining mediator: waiting for in-flight room service calls")
+
+	inflightDone := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(inflightDone)
+	}()
+
+	select {
+	case <-inflightDone:
+	case <-ctx.Done():
+		logrus.Warnf("Grace period expired while waiting for in-flight room service calls")
+	}
+
+	sessions := m.sessions.GetOpenSessions()
+	logrus.Infof("Draining mediator: closing %d sessions", len(sessions))
+
+	for _, session := range sessions {
+		for _, userInfo := range session.Users() {
+			msg, err := gameon.NewMessage(gameon.DirectionPlayer, userInfo.UserID, gameon.Event{
+				Type: "event",
+				Content: map[string]string{
+					userInfo.UserID: restartingMessage,
+				},
+			})
+			if err == nil {
+				sendMessage(msg, session)
+			}
+		}
+
+		session.CloseWithReason(websocket.CloseGoingAway, "Room is restarting")
+	}
+
+	m.drainMutex.Lock()
+	m.closing = true
+	m.drainMutex.Unlock()
+
+	farewellsDone := make(chan struct{})
+	go func() {
+		m.farewells.Wait()
+		close(farewellsDone)
+	}()
+
+	select {
+	case <-farewellsDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, session := range sessions {
+		select {
+		case <-session.Flushed():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"sort"
+	"unicode"
+)
+
+// automatonProfanityChecker matches profanities as whole words of the normalized text (see normalize), like
+// regexProfanityChecker, with an Aho-Corasick automaton scanning each message once, whatever the number of profanities.
+//
+// Repeated characters are handled by matching runs of characters rather than characters: the automaton matches
+// the sequence of distinct characters (e.g., "poop" is "pop"), and matches are then checked for the length
+// of each run (e.g., "poop" needs at least two o's, so "pop" doesn't match).
+type automatonProfanityChecker struct {
+	nodes       []*automatonNode
+	profanities []automatonProfanity
+	allowed     map[string]bool
+}
+
+type automatonProfanity struct {
+	profanity
+
+	// runs are the runs of characters of the normalized profanity.
+	runs []charRun
+}
+
+// charRun is a character repeated count times in a row.
+type charRun struct {
+	r     rune
+	count int
+}
+
+type automatonNode struct {
+	next map[rune]int
+
+	// fail is the node of the longest proper suffix of the node's sequence which is also in the automaton,
+	// and output the nearest node along the fail links ending a profanity (0 if none).
+	fail   int
+	output int
+
+	// profanities are the indexes of the profanities the node's sequence ends, in the order they were given.
+	// Several profanities may end on the same sequence, e.g. "pop" and "poop".
+	profanities []int
+
+	// depth is the length of the node's sequence.
+	depth int
+}
+
+func newAutomatonProfanityChecker(profanities []profanity, allowList []string) *automatonProfanityChecker {
+	c := &automatonProfanityChecker{
+		nodes:   []*automatonNode{newAutomatonNode(0)},
+		allowed: allowedWords(allowList),
+	}
+
+	for _, p := range profanities {
+		runs := charRuns(normalize(p.term).runes)
+		if len(runs) == 0 {
+			continue
+		}
+
+		c.insert(runs, len(c.profanities))
+		c.profanities = append(c.profanities, automatonProfanity{profanity: p, runs: runs})
+	}
+	c.link()
+
+	return c
+}
+
+func newAutomatonNode(depth int) *automatonNode {
+	return &automatonNode{next: make(map[rune]int), depth: depth}
+}
+
+// insert adds the sequence of characters of the runs to the automaton's trie, ending the given profanity.
+func (c *automatonProfanityChecker) insert(runs []charRun, profanity int) {
+	node := 0
+	for _, run := range runs {
+		next, ok := c.nodes[node].next[run.r]
+		if !ok {
+			next = len(c.nodes)
+			c.nodes = append(c.nodes, newAutomatonNode(c.nodes[node].depth+1))
+			c.nodes[node].next[run.r] = next
+		}
+		node = next
+	}
+
+	c.nodes[node].profanities = append(c.nodes[node].profanities, profanity)
+}
+
+// link sets the fail and output links of the trie's nodes, breadth first.
+func (c *automatonProfanityChecker) link() {
+	queue := make([]int, 0, len(c.nodes))
+	for _, child := range c.nodes[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		node := c.nodes[queue[0]]
+		queue = queue[1:]
+
+		for r, child := range node.next {
+			queue = append(queue, child)
+
+			fail := node.fail
+			for fail != 0 && !c.hasNext(fail, r) {
+				fail = c.nodes[fail].fail
+			}
+			if next, ok := c.nodes[fail].next[r]; ok {
+				fail = next
+			}
+			c.nodes[child].fail = fail
+
+			if len(c.nodes[fail].profanities) > 0 {
+				c.nodes[child].output = fail
+			} else {
+				c.nodes[child].output = c.nodes[fail].output
+			}
+		}
+	}
+}
+
+func (c *automatonProfanityChecker) hasNext(node int, r rune) bool {
+	_, ok := c.nodes[node].next[r]
+	return ok
+}
+
+func (c *automatonProfanityChecker) Check(content string) []ProfanityMatch {
+	normalized := normalize(content)
+	runs, firsts := normalizedRuns(normalized.runes)
+
+	// Only one match is kept per word start, the longest, as the regular expression would
+	var matches []ProfanityMatch
+	bestEnd := make(map[int]int)
+	bestMatch := make(map[int]int)
+
+	node := 0
+	for i, run := range runs {
+		for node != 0 && !c.hasNext(node, run.r) {
+			node = c.nodes[node].fail
+		}
+		if next, ok := c.nodes[node].next[run.r]; ok {
+			node = next
+		}
+
+		for out := node; out != 0; out = c.nodes[out].output {
+			if len(c.nodes[out].profanities) == 0 {
+				continue
+			}
+
+			start := i - c.nodes[out].depth + 1
+			p, end, ok := c.matchAt(runs, start, c.nodes[out].profanities)
+			if !ok {
+				continue
+			}
+
+			first, last := firsts[start], firsts[end+1]
+			word := runeString(normalized.runes[first:last])
+			if c.allowed[squeezeRepeats(word)] {
+				continue
+			}
+
+			if previous, ok := bestEnd[start]; ok && previous >= end {
+				continue
+			}
+			bestEnd[start] = end
+
+			origStart, origEnd := normalized.runeSpan(first, last)
+			match := ProfanityMatch{Term: p.term, Severity: p.severity, Start: origStart, End: origEnd}
+			if k, ok := bestMatch[start]; ok {
+				matches[k] = match
+			} else {
+				bestMatch[start] = len(matches)
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	sort.Sort(byStart(matches))
+	return matches
+}
+
+// matchAt returns the first of the profanities matching as a whole word at the given run, with enough repeats
+// of each of its characters, along with the run the match ends at (a plural "s" or "es" included).
+func (c *automatonProfanityChecker) matchAt(runs []charRun, start int, profanities []int) (automatonProfanity, int, bool) {
+	if start > 0 && isWordChar(runs[start-1].r) {
+		return automatonProfanity{}, 0, false
+	}
+
+	end := start + len(c.profanities[profanities[0]].runs) - 1
+	switch {
+	case isWordEnd(runs, end+1):
+	case isSingle(runs, end+1, 's') && isWordEnd(runs, end+2):
+		end++
+	case isSingle(runs, end+1, 'e') && isSingle(runs, end+2, 's') && isWordEnd(runs, end+3):
+		end += 2
+	default:
+		return automatonProfanity{}, 0, false
+	}
+
+	for _, i := range profanities {
+		if hasRepeats(runs[start:], c.profanities[i].runs) {
+			return c.profanities[i], end, true
+		}
+	}
+	return automatonProfanity{}, 0, false
+}
+
+// hasRepeats reports whether each character of the text repeats at least as many times as in the profanity.
+func hasRepeats(runs, profanityRuns []charRun) bool {
+	for k, run := range profanityRuns {
+		if runs[k].count < run.count {
+			return false
+		}
+	}
+	return true
+}
+
+// charRuns returns the runs of characters of normalized text.
+func charRuns(runes []normalizedRune) []charRun {
+	runs, _ := normalizedRuns(runes)
+	return runs
+}
+
+// normalizedRuns returns the runs of characters of normalized text, along with the index of the first rune
+// of each run (and, last, the number of runes).
+func normalizedRuns(runes []normalizedRune) ([]charRun, []int) {
+	var runs []charRun
+	var firsts []int
+	for i, nr := range runes {
+		if len(runs) > 0 && runs[len(runs)-1].r == nr.r {
+			runs[len(runs)-1].count++
+			continue
+		}
+		runs = append(runs, charRun{r: nr.r, count: 1})
+		firsts = append(firsts, i)
+	}
+	return runs, append(firsts, len(runes))
+}
+
+// isWordChar reports whether the character is part of a word, the same as nonWordChar doesn't match.
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// isWordEnd reports whether a word ends before the given run.
+func isWordEnd(runs []charRun, i int) bool {
+	return i >= len(runs) || !isWordChar(runs[i].r)
+}
+
+// isSingle reports whether the given run is the character on its own.
+func isSingle(runs []charRun, i int, r rune) bool {
+	return i < len(runs) && runs[i].r == r && runs[i].count == 1
+}
+
+func runeString(runes []normalizedRune) string {
+	s := make([]rune, len(runes))
+	for i, nr := range runes {
+		s[i] = nr.r
+	}
+	return string(s)
+}
+
+type byStart []ProfanityMatch
+
+func (m byStart) Len() int           { return len(m) }
+func (m byStart) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byStart) Less(i, j int) bool { return m[i].Start < m[j].Start }
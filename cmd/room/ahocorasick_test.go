@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// chatSamples are chat messages, as players write them.
+var chatSamples = []string{
+	"hey all, anyone seen the key to the cellar?",
+	"This wood is wooden, danger!",
+	"what c r a p, the door is stuck again",
+	"p00p happens lol",
+	"oh craaaap, I dropped the lamp",
+	"Anyone for craps? I've got dice",
+	"ｃｒａｐ, wrong room",
+	"сrар сrар сrар",
+	"boo​gers everywhere, ewww",
+	"Argh, MERDE alors! C'est la vie",
+	"dangs and poops and boobs, oh my",
+	"pop goes the weasel",
+	"Woohoo, we won! wooo!",
+	"l33t h4x0r here, room 101 anyone?",
+	"crap!crap!crap!",
+	"crapж and rжwoo.p, ñcrap or crap٣",
+	"ümerde merdeü, crap crap ж merde—ж",
+	"",
+}
+
+// generatedTerms returns n profanities, the built-in ones followed by made up ones, the same from one call to the next.
+func generatedTerms(n int) []profanity {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	letters := "abcdefghijklmnopqrstuvwxyz"
+
+	terms := make([]profanity, 0, n)
+	for i := 0; i < n; i++ {
+		if i < len(profanities) {
+			terms = append(terms, profanities[i])
+			continue
+		}
+
+		word := make([]byte, 4+rnd.Intn(6))
+		for k := range word {
+			word[k] = letters[rnd.Intn(len(letters))]
+		}
+		terms = append(terms, profanity{term: string(word), severity: Severity(1 + rnd.Intn(3))})
+	}
+	return terms
+}
+
+func TestAutomatonMatchesRegex(t *testing.T) {
+	for _, n := range []int{len(profanities), 1000} {
+		terms := generatedTerms(n)
+		regex := newRegexProfanityChecker(terms, defaultAllowList)
+		automaton := newAutomatonProfanityChecker(terms, defaultAllowList)
+
+		for _, content := range chatSamples {
+			want := regex.Check(content)
+			if got := automaton.Check(content); !reflect.DeepEqual(got, want) {
+				t.Errorf("%d terms: automaton Check(%q) = %+v, regex = %+v", n, content, got, want)
+			}
+		}
+	}
+}
+
+// benchmarkChecker benchmarks checking chat samples against more and more terms. In short mode,
+// checkers are only given up to maxShort terms.
+func benchmarkChecker(b *testing.B, newChecker func([]profanity, []string) ProfanityChecker, maxShort int) {
+	for _, n := range []int{10, 1000, 50000} {
+		b.Run(fmt.Sprintf("terms=%d", n), func(b *testing.B) {
+			if n > maxShort && testing.Short() {
+				b.Skipf("skipping %d terms in short mode", n)
+			}
+
+			checker := newChecker(generatedTerms(n), defaultAllowList)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				checker.Check(chatSamples[i%len(chatSamples)])
+			}
+		})
+	}
+}
+
+// BenchmarkRegex only gets to 50k terms out of short mode: the regular expression then takes minutes a message,
+// which is what the automaton is for.
+func BenchmarkRegex(b *testing.B) {
+	benchmarkChecker(b, func(terms []profanity, allowList []string) ProfanityChecker {
+		return newRegexProfanityChecker(terms, allowList)
+	}, 1000)
+}
+
+func BenchmarkAutomaton(b *testing.B) {
+	benchmarkChecker(b, func(terms []profanity, allowList []string) ProfanityChecker {
+		return newAutomatonProfanityChecker(terms, allowList)
+	}, 50000)
+}
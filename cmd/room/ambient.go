@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+var ambientEvents = []string{
+	"A cold draft sweeps across the room",
+	"Somewhere in the dark, someone laughs a little too loud",
+	"The lights flicker for a moment",
+	"You hear footsteps behind the heavy metal door",
+}
+
+// ambience periodically publishes an ambient event to everyone in each hosted room, over the push channel.
+// It is disabled unless AMBIENT_INTERVAL is set.
+func (r *room) ambience() {
+	interval := env.Duration("AMBIENT_INTERVAL", 0)
+	if interval == 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		for _, hosted := range r.hostedRooms() {
+			if hosted.roster.Count() == 0 {
+				continue
+			}
+
+			r.push.Publish(gameon.Message{
+				Direction: "player",
+				Recipient: "*",
+				Payload: jsonMarshal(gameon.Event{
+					Type: "event",
+					Content: map[string]string{
+						"*": ambientEvents[rand.Intn(len(ambientEvents))],
+					},
+				}),
+				Room: hosted.id,
+			})
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+// maxSuggestionDistance is the largest edit distance between an unknown command and a suggested one.
+const maxSuggestionDistance = 2
+
+// cannedCommandDescription describes the commands answered with a canned response from the room definition.
+const cannedCommandDescription = "Something particular to this room"
+
+// command is a slash command players may use in the room.
+type command struct {
+	// name is the command, slash included (e.g., "/go"), and aliases are other names it goes by.
+	name    string
+	aliases []string
+
+	// usage shows the command's arguments (e.g., "/go <direction>"), and description what it does.
+	usage       string
+	description string
+
+	// minArgs and maxArgs bound the number of arguments the command takes; a negative maxArgs means no limit.
+	minArgs int
+	maxArgs int
+
+	handler func(r *room, call *commandCall) []gameon.Message
+}
+
+// commandCall is a slash command issued by a player.
+type commandCall struct {
+	gameon.UserInfo
+
+	hosted *hostedRoom
+	def    *roomDefinition
+
+	// name is the command name, as typed by the player (in lower case), and args its arguments.
+	name string
+	args []string
+}
+
+// reply returns an event telling the player issuing the command about its outcome.
+func (call *commandCall) reply(content string) gameon.Message {
+	return gameon.Message{
+		Direction: "player",
+		Recipient: call.UserID,
+		Payload: jsonMarshal(gameon.Event{
+			Type: "event",
+			Content: map[string]string{
+				call.UserID: content,
+			},
+		}),
+		Room: call.hosted.id,
+	}
+}
+
+// broadcast returns an event telling everyone in the room about the outcome of the command,
+// in the player's own words and in everyone else's.
+func (call *commandCall) broadcast(own, others string) gameon.Message {
+	return gameon.Message{
+		Direction: "player",
+		Recipient: gameon.AllRecipients,
+		Payload: jsonMarshal(gameon.Event{
+			Type: "event",
+			Content: map[string]string{
+				call.UserID: own,
+				"*":         others,
+			},
+		}),
+		Room: call.hosted.id,
+	}
+}
+
+// builtinCommands returns the slash commands implemented by the room service.
+func builtinCommands() []*command {
+	return []*command{
+		{
+			name:        "/go",
+			usage:       "/go <direction>",
+			description: "Leave the room through one of its exits",
+			minArgs:     1,
+			maxArgs:     1,
+			handler:     (*room).goCommand,
+		},
+		{
+			name:        "/look",
+			aliases:     []string{"/l"},
+			usage:       "/look",
+			description: "Look around the room",
+			maxArgs:     -1,
+			handler:     (*room).lookCommand,
+		},
+		{
+			name:        "/who",
+			usage:       "/who",
+			description: "List who is in the room, and since when",
+			handler:     (*room).whoCommand,
+		},
+		{
+			name:        "/take",
+			aliases:     []string{"/get"},
+			usage:       "/take <item>",
+			description: "Pick up an item lying around",
+			minArgs:     1,
+			maxArgs:     -1,
+			handler:     (*room).takeCommand,
+		},
+		{
+			name:        "/drop",
+			usage:       "/drop <item>",
+			description: "Drop an item you carry",
+			minArgs:     1,
+			maxArgs:     -1,
+			handler:     (*room).dropCommand,
+		},
+		{
+			name:        "/examine",
+			aliases:     []string{"/x"},
+			usage:       "/examine <item>",
+			description: "Take a closer look at an item, around or carried",
+			minArgs:     1,
+			maxArgs:     -1,
+			handler:     (*room).examineCommand,
+		},
+		{
+			name:        "/inventory",
+			aliases:     []string{"/i"},
+			usage:       "/inventory",
+			description: "List the items you carry",
+			handler:     (*room).inventoryCommand,
+		},
+		{
+			name:        "/help",
+			aliases:     []string{"/?"},
+			usage:       "/help [command]",
+			description: "List the commands of the room, or explain one of them",
+			maxArgs:     1,
+			handler:     (*room).helpCommand,
+		},
+	}
+}
+
+// isBuiltinCommand reports whether the name is the name or an alias of a built-in command.
+func isBuiltinCommand(name string) bool {
+	for _, cmd := range builtinCommands() {
+		if cmd.name == name || contains(cmd.aliases, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandRegistry holds the slash commands of the room service.
+// Rooms may add commands of their own, answered with canned responses from their definitions.
+type commandRegistry struct {
+	// commands holds the commands in registration order, and byName maps their names and aliases to them.
+	commands []*command
+	byName   map[string]*command
+}
+
+func newCommandRegistry(commands ...*command) *commandRegistry {
+	registry := &commandRegistry{byName: make(map[string]*command)}
+	for _, cmd := range commands {
+		registry.Register(cmd)
+	}
+	return registry
+}
+
+// Register adds a command to the registry. It panics if the command's name or aliases are already taken.
+func (registry *commandRegistry) Register(cmd *command) {
+	for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+		if _, ok := registry.byName[name]; ok {
+			panic(fmt.Sprintf("duplicate command: %s", name))
+		}
+		registry.byName[name] = cmd
+	}
+	registry.commands = append(registry.commands, cmd)
+}
+
+// Lookup returns the command with the given name or alias, or nil if there's none.
+func (registry *commandRegistry) Lookup(name string) *command {
+	return registry.byName[name]
+}
+
+// Dispatch runs the command called by the player, and returns the messages it results in.
+func (registry *commandRegistry) Dispatch(r *room, call *commandCall) []gameon.Message {
+	cmd := registry.Lookup(call.name)
+	if cmd == nil {
+		if response, ok := call.def.Responses[call.name]; ok {
+			return []gameon.Message{call.reply(response)}
+		}
+
+		content := fmt.Sprintf("Don't know how to %s", call.name[1:])
+		if suggestion := registry.Suggest(call.name, call.def); suggestion != "" {
+			content += fmt.Sprintf(". Did you mean %s?", suggestion)
+		}
+		return []gameon.Message{call.reply(content)}
+	}
+
+	if len(call.args) < cmd.minArgs || cmd.maxArgs >= 0 && len(call.args) > cmd.maxArgs {
+		return []gameon.Message{call.reply(fmt.Sprintf("Usage: %s", cmd.usage))}
+	}
+
+	return cmd.handler(r, call)
+}
+
+// Descriptions maps the names of the commands available in the room to their descriptions,
+// as sent in the commands of a Location.
+func (registry *commandRegistry) Descriptions(def *roomDefinition) map[string]string {
+	descriptions := make(map[string]string, len(registry.commands)+len(def.Responses))
+	for _, cmd := range registry.commands {
+		descriptions[cmd.name] = cmd.description
+	}
+	for name := range def.Responses {
+		descriptions[name] = cannedCommandDescription
+	}
+	return descriptions
+}
+
+// Suggest returns the name of the command available in the room closest to the given one,
+// or an empty string if none comes close.
+func (registry *commandRegistry) Suggest(name string, def *roomDefinition) string {
+	var candidates []string
+	for candidate := range registry.byName {
+		candidates = append(candidates, candidate)
+	}
+	for candidate := range def.Responses {
+		candidates = append(candidates, candidate)
+	}
+
+	// Sorting makes suggestions stable among equally close candidates
+	sort.Strings(candidates)
+
+	suggestion, best := "", maxSuggestionDistance+1
+	for _, candidate := range candidates {
+		distance := editDistance(name, candidate)
+		if distance < best {
+			suggestion, best = candidate, distance
+		}
+	}
+
+	// Suggesting a name is pointless when it takes rewriting most of it
+	if best >= len(name)-1 {
+		return ""
+	}
+
+	return suggestion
+}
+
+func (r *room) goCommand(call *commandCall) []gameon.Message {
+	exitID := strings.ToUpper(call.args[0])
+	exit, ok := call.def.Exits[exitID]
+	if !ok {
+		return []gameon.Message{call.reply("You probably don't wanna go there...")}
+	}
+
+	// Exits leading to another hosted room are taken right here, without going through Game On
+	if target, targetDef := r.lookupHosted(exit.Target); target != nil {
+		return r.move(call.hosted, target, targetDef, call.UserInfo)
+	}
+
+	return []gameon.Message{{
+		Direction: "playerLocation",
+		Recipient: call.UserID,
+		Payload: jsonMarshal(gameon.PlayerLocation{
+			Type:    "exit",
+			Content: "You frantically run towards the exit",
+			ExitID:  exitID,
+		}),
+		Room: call.hosted.id,
+	}}
+}
+
+func (r *room) lookCommand(call *commandCall) []gameon.Message {
+	return []gameon.Message{call.reply(call.hosted.look(call.def, call.UserID))}
+}
+
+func (r *room) whoCommand(call *commandCall) []gameon.Message {
+	return []gameon.Message{call.reply(call.hosted.who())}
+}
+
+func (r *room) helpCommand(call *commandCall) []gameon.Message {
+	if len(call.args) == 0 {
+		descriptions := r.commands.Descriptions(call.def)
+
+		names := make([]string, 0, len(descriptions))
+		for name := range descriptions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lines := make([]string, 0, len(names)+1)
+		lines = append(lines, "You can use these commands:")
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s - %s", name, descriptions[name]))
+		}
+		return []gameon.Message{call.reply(strings.Join(lines, "\n"))}
+	}
+
+	name := strings.ToLower(call.args[0])
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+
+	cmd := r.commands.Lookup(name)
+	if cmd == nil {
+		if _, ok := call.def.Responses[name]; ok {
+			return []gameon.Message{call.reply(fmt.Sprintf("%s - %s", name, cannedCommandDescription))}
+		}
+
+		content := fmt.Sprintf("There's no %s command", name)
+		if suggestion := r.commands.Suggest(name, call.def); suggestion != "" {
+			content += fmt.Sprintf(". Did you mean %s?", suggestion)
+		}
+		return []gameon.Message{call.reply(content)}
+	}
+
+	content := fmt.Sprintf("%s - %s", cmd.usage, cmd.description)
+	if len(cmd.aliases) > 0 {
+		content += fmt.Sprintf(" (also %s)", strings.Join(cmd.aliases, ", "))
+	}
+	return []gameon.Message{call.reply(content)}
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exitIDs are the exits a Game On room may have.
+var exitIDs = map[string]bool{"N": true, "S": true, "E": true, "W": true, "U": true, "D": true}
+
+// roomDefinition describes a room: what it looks like, where its exits lead, and how it answers commands.
+// Definitions are loaded from the JSON file (or directory of JSON files) set with ROOM_DEFINITION,
+// so that rooms can change without a release.
+//
+// ID is the Game On ID of the room. A definition without an ID serves every room without a definition of its own.
+type roomDefinition struct {
+	ID          string                    `json:"id,omitempty"`
+	Name        string                    `json:"name"`
+	FullName    string                    `json:"fullName"`
+	Description string                    `json:"description"`
+	Exits       map[string]exitDefinition `json:"exits"`
+	Items       []itemDefinition          `json:"items"`
+
+	// Responses maps slash commands (e.g., "/examine") to canned replies.
+	Responses map[string]string `json:"responses"`
+
+	// KickExit is the exit players are thrown out of the room through, if set.
+	KickExit string `json:"kickExit,omitempty"`
+}
+
+type exitDefinition struct {
+	Description string `json:"description"`
+
+	// Target is the ID of the room the exit leads to, if known.
+	// Exits leading to another room hosted by the room service move the player there directly.
+	Target string `json:"target,omitempty"`
+}
+
+// itemDefinition describes an item lying around in a room at first. Carryable items may be taken by players.
+type itemDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Carryable   bool   `json:"carryable,omitempty"`
+}
+
+// defaultDefinition is the room served when no definition file is configured.
+var defaultDefinition = &roomDefinition{
+	Name:        "Chatter",
+	FullName:    "A chat room",
+	Description: "A darkly lit room",
+	Exits: map[string]exitDefinition{
+		"N": {Description: "An old wooden door with a large arrow carved on its center"},
+		"S": {Description: "A heavy metal door with signs of rust"},
+		"W": {Description: "A gray, plain looking door"},
+		"E": {Description: "A door surrounded by a mysterious glow along it edges"},
+	},
+	Items: []itemDefinition{
+		{Name: "couch", Description: "A worn out leather couch, facing the wall"},
+		{Name: "flyer", Description: "A flyer for a chat room meetup, last Tuesday", Carryable: true},
+	},
+}
+
+// loadDefinitions reads and validates the room definitions set with ROOM_DEFINITION, keyed by room ID.
+// ROOM_DEFINITION names either a single definition file, or a directory of definition (*.json) files.
+// The default definition is used when it isn't set.
+func loadDefinitions() (map[string]*roomDefinition, error) {
+	path := os.Getenv("ROOM_DEFINITION")
+	if path == "" {
+		return map[string]*roomDefinition{"": defaultDefinition}, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no room definitions found in %s", path)
+		}
+	}
+
+	defs := make(map[string]*roomDefinition, len(files))
+	for _, file := range files {
+		def, err := loadDefinition(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if other, ok := defs[def.ID]; ok {
+			if def.ID == "" {
+				return nil, fmt.Errorf("rooms %s and %s both lack an ID", other.Name, def.Name)
+			}
+			return nil, fmt.Errorf("rooms %s and %s share ID %s", other.Name, def.Name, def.ID)
+		}
+		defs[def.ID] = def
+	}
+
+	return defs, nil
+}
+
+func loadDefinition(path string) (*roomDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var def roomDefinition
+	err = json.Unmarshal(data, &def)
+	if err != nil {
+		return nil, fmt.Errorf("invalid room definition %s: %v", path, err)
+	}
+
+	err = def.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid room definition %s: %v", path, err)
+	}
+
+	return &def, nil
+}
+
+func (def *roomDefinition) validate() error {
+	if def.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if def.Description == "" {
+		return fmt.Errorf("missing description")
+	}
+
+	for id, exit := range def.Exits {
+		if !exitIDs[id] {
+			return fmt.Errorf("invalid exit %q, expected one of N, S, E, W, U or D", id)
+		}
+		if exit.Description == "" {
+			return fmt.Errorf("missing description for exit %s", id)
+		}
+		if exit.Target != "" && exit.Target == def.ID {
+			return fmt.Errorf("exit %s leads back to the room itself", id)
+		}
+	}
+
+	if _, ok := def.Exits[def.KickExit]; def.KickExit != "" && !ok {
+		return fmt.Errorf("kick exit %s isn't an exit of the room", def.KickExit)
+	}
+
+	names := make(map[string]bool)
+	for _, item := range def.Items {
+		if item.Name == "" {
+			return fmt.Errorf("missing item name")
+		}
+		name := strings.ToLower(item.Name)
+		if names[name] {
+			return fmt.Errorf("duplicate item %q", item.Name)
+		}
+		names[name] = true
+	}
+
+	for command, response := range def.Responses {
+		if !strings.HasPrefix(command, "/") || strings.ContainsAny(command, " \t") || command != strings.ToLower(command) {
+			return fmt.Errorf("invalid command %q, expected a lower case slash command", command)
+		}
+		if isBuiltinCommand(command) {
+			return fmt.Errorf("command %s is built in, and can't have a canned response", command)
+		}
+		if response == "" {
+			return fmt.Errorf("missing response for command %s", command)
+		}
+	}
+
+	return nil
+}
+
+// exitDescriptions returns the exits in the form of a Location's exits.
+func (def *roomDefinition) exitDescriptions() map[string]string {
+	exits := make(map[string]string, len(def.Exits))
+	for id, exit := range def.Exits {
+		exits[id] = exit.Description
+	}
+	return exits
+}
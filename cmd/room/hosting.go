@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+// defaultMaxFallbackRooms is the default number of rooms the definition without an ID serves at once.
+const defaultMaxFallbackRooms = 100
+
+// hostedRoom is the state of one of the rooms hosted by the room service.
+// Its definition is kept by the room service, as it may be reloaded at any time.
+type hostedRoom struct {
+	id     string
+	roster *roster
+	floor  *floor
+}
+
+// lookup returns the hosted room with the given ID and its current definition,
+// or nil if the room service doesn't host such a room.
+func (r *room) lookup(roomID string) (*hostedRoom, *roomDefinition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	def := definitionFor(r.defs, roomID)
+	if def == nil {
+		return nil, nil
+	}
+
+	if _, ok := r.defs[roomID]; !ok && !r.makeRoomFor(roomID) {
+		return nil, nil
+	}
+
+	return r.hosted(roomID, def), def
+}
+
+// makeRoomFor reports whether the room without a definition of its own may be hosted, as there are at most
+// maxFallbackRooms such rooms. Rooms nobody is in are evicted to make room for new ones.
+// The caller must hold the lock.
+func (r *room) makeRoomFor(roomID string) bool {
+	if _, ok := r.rooms[roomID]; ok {
+		return true
+	}
+
+	var fallbacks []string
+	for id := range r.rooms {
+		if _, ok := r.defs[id]; !ok {
+			fallbacks = append(fallbacks, id)
+		}
+	}
+	if len(fallbacks) < r.maxFallbackRooms {
+		return true
+	}
+
+	for _, id := range fallbacks {
+		if r.rooms[id].roster.Count() == 0 {
+			logrus.Infof("Evicting empty room %s to host room %s", id, roomID)
+			delete(r.rooms, id)
+			return true
+		}
+	}
+
+	logrus.Warnf("Not hosting room %s, as %d rooms without a definition of their own are busy already", roomID, len(fallbacks))
+	return false
+}
+
+// definitionFor returns the definition of the room with the given ID, falling back on the definition without an ID.
+func definitionFor(defs map[string]*roomDefinition, roomID string) *roomDefinition {
+	if def, ok := defs[roomID]; ok {
+		return def
+	}
+	return defs[""]
+}
+
+// lookupHosted is like lookup, except that it only returns rooms with a definition of their own.
+// It resolves the targets of exits, which may lead out of the room service.
+func (r *room) lookupHosted(roomID string) (*hostedRoom, *roomDefinition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	def, ok := r.defs[roomID]
+	if !ok || roomID == "" {
+		return nil, nil
+	}
+
+	return r.hosted(roomID, def), def
+}
+
+// hosts reports whether the room with the given ID has a definition of its own, which exits may lead to.
+func (r *room) hosts(roomID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.defs[roomID]
+	return ok && roomID != ""
+}
+
+// hosted returns the state of the room, creating it from its definition on first use.
+// The caller must hold the lock.
+func (r *room) hosted(roomID string, def *roomDefinition) *hostedRoom {
+	hosted, ok := r.rooms[roomID]
+	if !ok {
+		hosted = &hostedRoom{id: roomID, roster: newRoster(r.presenceTTL), floor: newFloor(def.Items)}
+		r.rooms[roomID] = hosted
+	}
+	return hosted
+}
+
+// hostedRooms returns the rooms hosted so far.
+func (r *room) hostedRooms() []*hostedRoom {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	rooms := make([]*hostedRoom, 0, len(r.rooms))
+	for _, hosted := range r.rooms {
+		rooms = append(rooms, hosted)
+	}
+	return rooms
+}
+
+// enter adds the player to the hosted room, removing it from any other hosted room it was in.
+func (r *room) enter(hosted *hostedRoom, userInfo gameon.UserInfo) {
+	for _, other := range r.hostedRooms() {
+		if other != hosted {
+			other.roster.Leave(userInfo.UserID)
+		}
+	}
+
+	hosted.roster.Enter(userInfo)
+}
+
+// move takes the player from one hosted room to another, returning the messages telling everyone about it.
+func (r *room) move(from, to *hostedRoom, toDef *roomDefinition, userInfo gameon.UserInfo) []gameon.Message {
+	logrus.Infof("Player %s moving from room %s to room %s", userInfo.UserID, from.id, to.id)
+
+	leaving := gameon.Message{
+		Direction: "player",
+		Recipient: "*",
+		Payload: jsonMarshal(gameon.Event{
+			Type: "event",
+			Content: map[string]string{
+				userInfo.UserID: "You frantically run towards the exit",
+				"*":             fmt.Sprintf("%s has left the room", userInfo.Username),
+			},
+		}),
+		Room: from.id,
+	}
+
+	r.enter(to, userInfo)
+
+	// The location message moves the player to the other room, so it must come before the welcome
+	return []gameon.Message{leaving, r.location(to, toDef, userInfo.UserID), to.welcome(userInfo)}
+}
+
+// reload loads the room definitions again, keeping the current ones if any is invalid.
+// Players and everything else the rooms keep track of are left alone, except for rooms no longer defined.
+func (r *room) reload() {
+	defs, err := loadDefinitions()
+	if err != nil {
+		logrus.WithError(err).Errorf("Error reloading room definitions, keeping the current ones")
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous := r.defs
+	r.defs = defs
+	for roomID, hosted := range r.rooms {
+		def := definitionFor(defs, roomID)
+		if def == nil {
+			logrus.Warnf("Room %s is no longer defined, dropping it along with its %d players", roomID, hosted.roster.Count())
+			delete(r.rooms, roomID)
+			continue
+		}
+
+		hosted.floor.Refresh(definitionFor(previous, roomID), def)
+	}
+
+	logrus.Infof("Reloaded %d room definitions", len(defs))
+}
+
+func (h *hostedRoom) welcome(userInfo gameon.UserInfo) gameon.Message {
+	return gameon.Message{
+		Direction: "player",
+		Recipient: "*",
+		Payload: jsonMarshal(gameon.Event{
+			Type: "event",
+			Content: map[string]string{
+				userInfo.UserID: "Welcome!",
+				"*":             fmt.Sprintf("%s has just entered the room", userInfo.Username),
+			},
+		}),
+		Room: h.id,
+	}
+}
+
+func (r *room) location(h *hostedRoom, def *roomDefinition, userID string) gameon.Message {
+	return gameon.Message{
+		Direction: "player",
+		Recipient: userID,
+		Payload: jsonMarshal(gameon.Location{
+			Type:        "location",
+			Name:        def.Name,
+			FullName:    def.FullName,
+			Description: fmt.Sprintf("%s. %s", def.Description, peopleAround(h.roster.Count())),
+			Exits:       def.exitDescriptions(),
+			Commands:    r.commands.Descriptions(def),
+			Inventory:   h.floor.Names(),
+		}),
+		Room: h.id,
+	}
+}
+
+// look describes the room, its items and the other players in it, as seen by the given player.
+func (h *hostedRoom) look(def *roomDefinition, userID string) string {
+	var others []string
+	for _, p := range h.roster.Present() {
+		if p.UserID != userID {
+			others = append(others, p.Username)
+		}
+	}
+
+	description := def.Description
+	if items := h.floor.Names(); len(items) > 0 {
+		description += fmt.Sprintf(". You see %s", listOf(withArticles(items)))
+	}
+
+	switch len(others) {
+	case 0:
+		return fmt.Sprintf("%s. You are all alone", description)
+	case 1:
+		return fmt.Sprintf("%s. %s is here", description, others[0])
+	default:
+		return fmt.Sprintf("%s. %s are here", description, listOf(others))
+	}
+}
+
+// who lists the players in the room, with how long each has been there.
+func (h *hostedRoom) who() string {
+	players := h.roster.Present()
+	if len(players) == 0 {
+		return "Nobody is here"
+	}
+
+	now := h.roster.now()
+	lines := make([]string, 0, len(players))
+	for _, p := range players {
+		lines = append(lines, fmt.Sprintf("%s (here for %s)", p.Username, now.Sub(p.since)/time.Second*time.Second))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// listOf joins the names into an English list, e.g. "a, b and c".
+func listOf(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// peopleAround describes the head count of the room, which includes the player the location is sent to.
+func peopleAround(count int) string {
+	switch count {
+	case 0, 1:
+		return "There is nobody else around"
+	default:
+		return fmt.Sprintf("There are %d people here, some are walking around, some are standing in groups", count)
+	}
+}
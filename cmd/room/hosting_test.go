@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func TestLookupBoundsFallbackRooms(t *testing.T) {
+	r := newRoom(map[string]*roomDefinition{"": defaultDefinition})
+	r.maxFallbackRooms = 2
+
+	a, _ := r.lookup("a")
+	b, _ := r.lookup("b")
+	if a == nil || b == nil {
+		t.Fatalf("lookup(a), lookup(b) = %v, %v, want hosted rooms", a, b)
+	}
+	a.roster.Enter(gameon.UserInfo{UserID: "u1", Username: "bob"})
+	b.roster.Enter(gameon.UserInfo{UserID: "u2", Username: "alice"})
+
+	if c, _ := r.lookup("c"); c != nil {
+		t.Errorf("lookup(c) = %v with every fallback room busy, want nil", c)
+	}
+	if again, _ := r.lookup("a"); again != a {
+		t.Errorf("lookup(a) = %v, want the room already hosted", again)
+	}
+
+	b.roster.Leave("u2")
+	if c, _ := r.lookup("c"); c == nil {
+		t.Errorf("lookup(c) = nil with an empty fallback room, want it evicted")
+	}
+	if len(r.rooms) != 2 {
+		t.Errorf("hosting %d rooms, want 2", len(r.rooms))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const (
+	idempotencyTTL      = 2 * time.Minute
+	idempotencyCapacity = 4096
+)
+
+// idempotentResponse is a response recorded for an idempotency key.
+// done is closed once the response is complete, so that duplicates arriving meanwhile can wait for it.
+type idempotentResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	recordedAt  time.Time
+	done        chan struct{}
+}
+
+type idempotencyEntry struct {
+	key      string
+	response *idempotentResponse
+}
+
+// idempotencyCache replays the recorded response for calls retried with the same idempotency key,
+// so that the mediator can safely retry calls that aren't idempotent on their own (e.g., chat commands).
+type idempotencyCache struct {
+	responses map[string]*idempotentResponse
+
+	// order holds the responses in insertion order, for evicting the oldest ones first.
+	order []idempotencyEntry
+
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		responses: make(map[string]*idempotentResponse),
+		now:       time.Now,
+	}
+}
+
+// Wrap returns a handler replaying recorded responses for requests carrying an already seen idempotency key.
+// Requests without a key are passed through.
+func (c *idempotencyCache) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(gameon.IdempotencyKeyHeader)
+		if key == "" {
+			handler(resp, req)
+			return
+		}
+
+		cacheKey := req.URL.Path + " " + key
+		recorded, first := c.reserve(cacheKey)
+		if !first {
+			<-recorded.done
+			logrus.Debugf("Replaying response for duplicate %s request (idempotency key %s)", req.URL.Path, key)
+			c.replay(resp, recorded)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: resp, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// A panicking handler fails the call, so that duplicates waiting for it don't wait forever
+			if !completed {
+				recorded.status = http.StatusInternalServerError
+			}
+			close(recorded.done)
+
+			// A failed call wasn't handled, so a retry must be handled for real rather than replayed
+			if recorded.status >= 500 {
+				c.forget(cacheKey)
+			}
+		}()
+
+		handler(recorder, req)
+
+		recorded.status = recorder.status
+		recorded.contentType = recorder.Header().Get("Content-Type")
+		recorded.body = recorder.body.Bytes()
+		completed = true
+	}
+}
+
+func (c *idempotencyCache) forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.responses, key)
+}
+
+// reserve returns the response recorded for the key, or reserves a new one,
+// reporting whether the caller is the first to use the key.
+func (c *idempotencyCache) reserve(key string) (*idempotentResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.evict()
+
+	if recorded, ok := c.responses[key]; ok {
+		return recorded, false
+	}
+
+	recorded := &idempotentResponse{
+		recordedAt: c.now(),
+		done:       make(chan struct{}),
+	}
+	c.responses[key] = recorded
+	c.order = append(c.order, idempotencyEntry{key: key, response: recorded})
+
+	return recorded, true
+}
+
+// evict drops expired responses, as well as the oldest ones beyond capacity.
+// The caller must hold the cache's lock.
+func (c *idempotencyCache) evict() {
+	now := c.now()
+
+	n := 0
+	for _, entry := range c.order {
+		expired := now.Sub(entry.response.recordedAt) > idempotencyTTL
+		overflow := len(c.order)-n > idempotencyCapacity
+		if !expired && !overflow {
+			break
+		}
+		// The key may have been forgotten, and reserved again since
+		if c.responses[entry.key] == entry.response {
+			delete(c.responses, entry.key)
+		}
+		n++
+	}
+	c.order = c.order[n:]
+}
+
+func (c *idempotencyCache) replay(resp http.ResponseWriter, recorded *idempotentResponse) {
+	if recorded.contentType != "" {
+		resp.Header().Set("Content-Type", recorded.contentType)
+	}
+	resp.WriteHeader(recorded.status)
+	resp.Write(recorded.body)
+}
+
+// responseRecorder passes a response through, while keeping a copy of its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func newIdempotentRequest(key string) *http.Request {
+	req := httptest.NewRequest("POST", "/room", nil)
+	req.Header.Set(gameon.IdempotencyKeyHeader, key)
+	return req
+}
+
+func TestIdempotencyReplaysDuplicates(t *testing.T) {
+	calls := 0
+	handler := newIdempotencyCache().Wrap(func(resp http.ResponseWriter, req *http.Request) {
+		calls++
+		resp.WriteHeader(http.StatusOK)
+		resp.Write([]byte("done"))
+	})
+
+	for i := 0; i < 2; i++ {
+		resp := httptest.NewRecorder()
+		handler(resp, newIdempotentRequest("key"))
+		if resp.Code != http.StatusOK || resp.Body.String() != "done" {
+			t.Errorf("call %d = %d %q, want 200 \"done\"", i, resp.Code, resp.Body.String())
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("handler called %d times, want once", calls)
+	}
+}
+
+func TestIdempotencyHandlerPanic(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+	handler := newIdempotencyCache().Wrap(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+			panic("boom")
+		}
+		resp.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		defer func() { recover() }()
+		handler(httptest.NewRecorder(), newIdempotentRequest("key"))
+	}()
+	<-started
+
+	duplicate := make(chan int)
+	go func() {
+		resp := httptest.NewRecorder()
+		handler(resp, newIdempotentRequest("key"))
+		duplicate <- resp.Code
+	}()
+
+	// Let the duplicate wait for the first call before it panics
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case code := <-duplicate:
+		if code != http.StatusInternalServerError {
+			t.Errorf("duplicate of a panicking call = %d, want 500", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("duplicate of a panicking call is still waiting")
+	}
+
+	// The failed call was forgotten, so a retry is handled for real
+	resp := httptest.NewRecorder()
+	handler(resp, newIdempotentRequest("key"))
+	if resp.Code != http.StatusOK {
+		t.Errorf("retry of a panicking call = %d, want 200", resp.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+// identityMaxAge bounds the clock skew and replay window allowed for signed identity headers.
+const identityMaxAge = time.Minute
+
+// identityVerifier checks the user identity headers signed by the mediator service,
+// so that nothing else reaching the room service can pose as a player.
+type identityVerifier struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func newIdentityVerifier() *identityVerifier {
+	secret := os.Getenv("IDENTITY_SECRET")
+	if secret == "" {
+		logrus.Warnf("IDENTITY_SECRET is not set, user identity headers will not be verified")
+	}
+
+	return &identityVerifier{
+		secret: []byte(secret),
+		now:    time.Now,
+	}
+}
+
+// Wrap returns a handler verifying the request identity before invoking the given handler.
+// The signature also covers the room the request is meant for, so that it can't be replayed against another room.
+// Requests failing verification are rejected with 401 Unauthorized.
+func (v *identityVerifier) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if len(v.secret) == 0 {
+		return handler
+	}
+
+	return func(resp http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		_, err = gameon.VerifyIdentity(req, v.secret, body, identityMaxAge, v.now())
+		if err != nil {
+			logrus.WithError(err).Errorf("Rejecting %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(resp, req)
+	}
+}
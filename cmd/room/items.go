@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+// inventories keeps track of the items carried by each player.
+// Players carry their items along as they move between hosted rooms.
+type inventories struct {
+	items map[string][]itemDefinition
+	mutex sync.Mutex
+}
+
+func newInventories() *inventories {
+	return &inventories{items: make(map[string][]itemDefinition)}
+}
+
+// Add gives the item to the player.
+func (inv *inventories) Add(userID string, item itemDefinition) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	inv.items[userID] = append(inv.items[userID], item)
+}
+
+// Remove takes the named item away from the player, and reports whether the player had it.
+func (inv *inventories) Remove(userID, name string) (itemDefinition, bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	items := inv.items[userID]
+	i := findItem(items, name)
+	if i < 0 {
+		return itemDefinition{}, false
+	}
+
+	item := items[i]
+	inv.items[userID] = append(items[:i:i], items[i+1:]...)
+	return item, true
+}
+
+// RemoveAll takes every item away from the player, and returns them.
+func (inv *inventories) RemoveAll(userID string) []itemDefinition {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	items := inv.items[userID]
+	delete(inv.items, userID)
+	return items
+}
+
+// Get returns the named item if the player carries it.
+func (inv *inventories) Get(userID, name string) (itemDefinition, bool) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	items := inv.items[userID]
+	i := findItem(items, name)
+	if i < 0 {
+		return itemDefinition{}, false
+	}
+	return items[i], true
+}
+
+// Names returns the names of the items carried by the player.
+func (inv *inventories) Names(userID string) []string {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	return itemNames(inv.items[userID])
+}
+
+// floor holds the items lying around in a hosted room.
+type floor struct {
+	items []itemDefinition
+	mutex sync.Mutex
+}
+
+func newFloor(items []itemDefinition) *floor {
+	return &floor{items: append([]itemDefinition(nil), items...)}
+}
+
+// Put leaves the items on the floor.
+func (f *floor) Put(items ...itemDefinition) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.items = append(f.items, items...)
+}
+
+// Get returns the named item if it lies on the floor.
+func (f *floor) Get(name string) (itemDefinition, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	i := findItem(f.items, name)
+	if i < 0 {
+		return itemDefinition{}, false
+	}
+	return f.items[i], true
+}
+
+// Take picks the named item up from the floor, as long as it can be carried.
+// It reports whether the item lies on the floor, and whether it was taken.
+func (f *floor) Take(name string) (item itemDefinition, found, taken bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	i := findItem(f.items, name)
+	if i < 0 {
+		return itemDefinition{}, false, false
+	}
+
+	item = f.items[i]
+	if !item.Carryable {
+		return item, true, false
+	}
+
+	f.items = append(f.items[:i:i], f.items[i+1:]...)
+	return item, true, true
+}
+
+// Names returns the names of the items lying on the floor.
+func (f *floor) Names() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return itemNames(f.items)
+}
+
+// Refresh puts on the floor the items added to the room's definition since the previous one.
+// Items removed from the definition are left where they are, on the floor or in a player's hands.
+func (f *floor) Refresh(previous, current *roomDefinition) {
+	var added []itemDefinition
+	for _, item := range current.Items {
+		if findItem(previous.Items, item.Name) < 0 {
+			added = append(added, item)
+		}
+	}
+
+	f.Put(added...)
+}
+
+// dropAll leaves the items carried by the player on the floor of the room, e.g. when the player leaves the game.
+func (r *room) dropAll(hosted *hostedRoom, userID string) {
+	hosted.floor.Put(r.inventories.RemoveAll(userID)...)
+}
+
+func (r *room) takeCommand(call *commandCall) []gameon.Message {
+	name := strings.Join(call.args, " ")
+
+	item, found, taken := call.hosted.floor.Take(name)
+	if !found {
+		return []gameon.Message{call.reply(fmt.Sprintf("There's no %s around here", name))}
+	}
+	if !taken {
+		return []gameon.Message{call.reply(fmt.Sprintf("The %s won't budge", item.Name))}
+	}
+
+	r.inventories.Add(call.UserID, item)
+	return []gameon.Message{call.broadcast(
+		fmt.Sprintf("You pick up the %s", item.Name),
+		fmt.Sprintf("%s picks up the %s", call.Username, item.Name))}
+}
+
+func (r *room) dropCommand(call *commandCall) []gameon.Message {
+	name := strings.Join(call.args, " ")
+
+	item, ok := r.inventories.Remove(call.UserID, name)
+	if !ok {
+		return []gameon.Message{call.reply(fmt.Sprintf("You don't have any %s", name))}
+	}
+
+	call.hosted.floor.Put(item)
+	return []gameon.Message{call.broadcast(
+		fmt.Sprintf("You drop the %s", item.Name),
+		fmt.Sprintf("%s drops the %s", call.Username, item.Name))}
+}
+
+func (r *room) examineCommand(call *commandCall) []gameon.Message {
+	name := strings.Join(call.args, " ")
+
+	item, ok := r.inventories.Get(call.UserID, name)
+	if !ok {
+		item, ok = call.hosted.floor.Get(name)
+	}
+	if !ok {
+		return []gameon.Message{call.reply(fmt.Sprintf("There's no %s around here", name))}
+	}
+
+	if item.Description == "" {
+		return []gameon.Message{call.reply(fmt.Sprintf("There's nothing special about the %s", item.Name))}
+	}
+	return []gameon.Message{call.reply(item.Description)}
+}
+
+func (r *room) inventoryCommand(call *commandCall) []gameon.Message {
+	names := r.inventories.Names(call.UserID)
+	if len(names) == 0 {
+		return []gameon.Message{call.reply("You aren't carrying anything")}
+	}
+	return []gameon.Message{call.reply(fmt.Sprintf("You are carrying %s", listOf(withArticles(names))))}
+}
+
+// findItem returns the index of the named item (regardless of case), or -1 if there's none.
+func findItem(items []itemDefinition, name string) int {
+	for i, item := range items {
+		if strings.EqualFold(item.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// withArticles prefixes item names with an indefinite article, e.g. "a flyer".
+func withArticles(names []string) []string {
+	prefixed := make([]string, len(names))
+	for i, name := range names {
+		if strings.ContainsAny(strings.ToLower(name[:1]), "aeiou") {
+			prefixed[i] = "an " + name
+		} else {
+			prefixed[i] = "a " + name
+		}
+	}
+	return prefixed
+}
+
+func itemNames(items []itemDefinition) []string {
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	return names
+}
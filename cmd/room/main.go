@@ -1,22 +1,89 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
 )
 
+const defaultShutdownGracePeriod = 10 * time.Second
+
 func main() {
 	logrus.Infof("Starting room service")
 
-	room := newRoom()
+	defs, err := loadDefinitions()
+	if err != nil {
+		logrus.WithError(err).Fatalf("Error loading room definitions")
+	}
 
-	http.HandleFunc("/hello", room.hello)
-	http.HandleFunc("/goodbye", room.goodbye)
-	http.HandleFunc("/room", room.room)
+	room := newRoom(defs)
+	identity := newIdentityVerifier()
+	idempotency := newIdempotencyCache()
 
-	err := http.ListenAndServe(":80", nil)
-	if err != nil {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", identity.Wrap(idempotency.Wrap(room.hello)))
+	mux.HandleFunc("/goodbye", identity.Wrap(idempotency.Wrap(room.goodbye)))
+	mux.HandleFunc("/join", identity.Wrap(idempotency.Wrap(room.join)))
+	mux.HandleFunc("/part", identity.Wrap(idempotency.Wrap(room.part)))
+	mux.HandleFunc("/room", identity.Wrap(idempotency.Wrap(room.room)))
+	mux.HandleFunc("/events", identity.Wrap(room.push.ServeHTTP))
+	if handler, ok := room.profanityChecker.(http.Handler); ok {
+		mux.Handle("/status/profanity", handler)
+	}
+	if handler := moderatorOnly(room.strikes); handler != nil {
+		mux.Handle("/moderation/strikes", handler)
+	}
+	server := &http.Server{Addr: ":80", Handler: mux}
+
+	go room.ambience()
+	go room.expirePresence()
+	if lists, ok := room.profanityChecker.(*wordListChecker); ok {
+		go lists.Watch()
+	}
+
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			room.reload()
+		}
+	}()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+
+		gracePeriod := env.Duration("SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod)
+		logrus.Infof("Received %s, shutting down (grace period: %s)", sig, gracePeriod)
+
+		// Stop accepting connections, and let in-flight requests complete.
+		// Push streams never complete on their own, so they are ended first.
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+
+		room.push.Close()
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Error shutting down HTTP server")
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		logrus.WithError(err).Fatalf("Error running main")
 	}
+
+	<-shutdownDone
+	logrus.Infof("Room service stopped")
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRepeats is the number of times a character may repeat in normalized text, e.g. "craaaap" becomes "craap".
+const maxRepeats = 2
+
+// minSpelledOut is the number of single letters in a row taken for a word spelled out, e.g. "c r a p".
+const minSpelledOut = 3
+
+// oneLetterWords are the words of a single letter, which don't begin a word spelled out, e.g. "a" in "a c r a p day".
+var oneLetterWords = map[rune]bool{'a': true, 'i': true}
+
+// foldedRunes maps accented letters and look-alike letters from other scripts to the plain latin letter.
+var foldedRunes = foldTable(map[rune]string{
+	'a': "àáâãäåāăąǎаα",
+	'b': "ь",
+	'c': "çćĉċčс",
+	'd': "ďđ",
+	'e': "èéêëēĕėęěеε",
+	'g': "ĝğġģ",
+	'h': "ĥħн",
+	'i': "ìíîïĩīĭįıіι",
+	'j': "ĵј",
+	'k': "ķкκ",
+	'l': "ĺļľŀł",
+	'n': "ñńņňŉη",
+	'o': "òóôõöøōŏőоο",
+	'p': "рρ",
+	'r': "ŕŗř",
+	's': "śŝşšſѕ",
+	't': "ţťŧт",
+	'u': "ùúûüũūŭůűų",
+	'w': "ŵ",
+	'x': "хχ",
+	'y': "ýÿŷуγ",
+	'z': "źżž",
+})
+
+func foldTable(variants map[rune]string) map[rune]rune {
+	table := make(map[rune]rune)
+	for base, runes := range variants {
+		for _, variant := range runes {
+			table[variant] = base
+		}
+	}
+	return table
+}
+
+// leetRunes maps the characters standing in for letters in leetspeak to the letters.
+var leetRunes = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+	'|': 'l',
+	'+': 't',
+}
+
+// normalizedRune is a character of normalized text, along with the bytes of the original text it stands for.
+type normalizedRune struct {
+	r          rune
+	start, end int
+}
+
+// normalizedText is text reduced to the canonical form profanities are matched against (see normalize),
+// which keeps track of where each of its characters comes from in the original text.
+type normalizedText struct {
+	text  string
+	runes []normalizedRune
+
+	// runeIndex maps the byte offset of each character of text (and of its end) to its index in runes.
+	runeIndex map[int]int
+}
+
+// normalize reduces text to a canonical form profanities are matched against, undoing the usual tricks
+// used to sneak them past a filter: it folds case, accents and look-alike letters, reads leetspeak,
+// joins words spelled out letter by letter, and caps repeated characters.
+func normalize(content string) *normalizedText {
+	runes := make([]normalizedRune, 0, len(content))
+	for i, r := range content {
+		runes = append(runes, normalizedRune{r: r, start: i, end: i + utf8.RuneLen(r)})
+	}
+
+	runes = foldRunes(runes)
+	runes = readLeet(runes)
+	runes = joinSpelledOut(runes)
+	runes = collapseRepeats(runes)
+
+	normalized := &normalizedText{runes: runes, runeIndex: make(map[int]int, len(runes)+1)}
+	var text bytes.Buffer
+	for i, nr := range runes {
+		normalized.runeIndex[text.Len()] = i
+		text.WriteRune(nr.r)
+	}
+	normalized.runeIndex[text.Len()] = len(runes)
+	normalized.text = text.String()
+
+	return normalized
+}
+
+// span returns the byte offsets in the original text of the normalized text between the given byte offsets.
+func (n *normalizedText) span(start, end int) (int, int) {
+	return n.runeSpan(n.runeIndex[start], n.runeIndex[end])
+}
+
+// runeSpan returns the byte offsets in the original text of the normalized runes between the given indexes.
+func (n *normalizedText) runeSpan(first, last int) (int, int) {
+	return n.runes[first].start, n.runes[last-1].end
+}
+
+// foldRunes lower cases the text, maps accented and look-alike letters to plain latin letters,
+// maps full-width forms to their ASCII counterparts, and drops invisible characters.
+func foldRunes(runes []normalizedRune) []normalizedRune {
+	folded := make([]normalizedRune, 0, len(runes))
+	for _, nr := range runes {
+		r := nr.r
+		switch {
+		case r == '\u00ad' || r >= '\u200b' && r <= '\u200d' || r == '\u2060' || r == '\ufeff':
+			// soft hyphens, zero-width spaces and joiners
+			continue
+		case r >= '\uff01' && r <= '\uff5e':
+			// full-width forms
+			r -= 0xfee0
+		}
+
+		r = unicode.ToLower(r)
+		if base, ok := foldedRunes[r]; ok {
+			r = base
+		}
+		nr.r = r
+		folded = append(folded, nr)
+	}
+	return folded
+}
+
+// readLeet maps leetspeak characters to letters, in words holding at least one actual letter (so that
+// numbers are left alone). Symbols are only mapped when followed by a letter or digit, so that trailing punctuation
+// (e.g., "crap!") is left alone as well.
+func readLeet(runes []normalizedRune) []normalizedRune {
+	read := make([]normalizedRune, len(runes))
+	copy(read, runes)
+
+	isWordRune := func(r rune) bool {
+		_, leet := leetRunes[r]
+		return unicode.IsLetter(r) || leet
+	}
+
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start].r) {
+			start++
+			continue
+		}
+
+		end := start
+		hasLetter := false
+		for end < len(runes) && isWordRune(runes[end].r) {
+			hasLetter = hasLetter || unicode.IsLetter(runes[end].r)
+			end++
+		}
+
+		if hasLetter {
+			for i := start; i < end; i++ {
+				r := runes[i].r
+				letter, leet := leetRunes[r]
+				if !leet {
+					continue
+				}
+				if unicode.IsDigit(r) || i+1 < end && (unicode.IsLetter(runes[i+1].r) || unicode.IsDigit(runes[i+1].r)) {
+					read[i].r = letter
+				}
+			}
+		}
+
+		start = end
+	}
+
+	return read
+}
+
+// joinSpelledOut joins words spelled out as single letters separated by spaces or punctuation,
+// e.g. "c r a p" or "c.r.a.p". Words spelled out never begin with one of oneLetterWords, which are taken
+// for the word they are (so "a b o o b" is "a boob").
+func joinSpelledOut(runes []normalizedRune) []normalizedRune {
+	joined := make([]normalizedRune, 0, len(runes))
+
+	for i := 0; i < len(runes); {
+		var letters []normalizedRune
+		end := i
+		for k := i; k < len(runes) && isSingleLetter(runes, k) && (k > i || !oneLetterWords[runes[k].r]); {
+			letters = append(letters, runes[k])
+			end = k + 1
+
+			k++
+			for k < len(runes) && isSeparator(runes[k].r) {
+				k++
+			}
+		}
+
+		if len(letters) >= minSpelledOut {
+			joined = append(joined, letters...)
+			i = end
+			continue
+		}
+
+		joined = append(joined, runes[i])
+		i++
+	}
+
+	return joined
+}
+
+// isSingleLetter reports whether the rune at index i is a letter standing on its own.
+func isSingleLetter(runes []normalizedRune, i int) bool {
+	return unicode.IsLetter(runes[i].r) &&
+		(i == 0 || !unicode.IsLetter(runes[i-1].r)) &&
+		(i+1 == len(runes) || !unicode.IsLetter(runes[i+1].r))
+}
+
+func isSeparator(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(".-_*,/\\~", r)
+}
+
+// collapseRepeats caps the number of times a character repeats in a row, e.g. "craaaap" becomes "craap".
+// The characters dropped are accounted for by the last one kept, so that "craap" still stands for all of "craaaap".
+func collapseRepeats(runes []normalizedRune) []normalizedRune {
+	collapsed := make([]normalizedRune, 0, len(runes))
+	repeats := 0
+	for i, nr := range runes {
+		if i > 0 && nr.r == runes[i-1].r {
+			repeats++
+		} else {
+			repeats = 1
+		}
+		if repeats <= maxRepeats {
+			collapsed = append(collapsed, nr)
+		} else {
+			collapsed[len(collapsed)-1].end = nr.end
+		}
+	}
+	return collapsed
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		content    string
+		normalized string
+	}{
+		{"This wood is wooden, danger!", "this wood is wooden, danger!"},
+		{"p00p happens", "poop happens"},
+		{"what c r a p", "what crap"},
+		{"what a c r a p day", "what a crap day"},
+		{"a b o o b", "a boob"},
+		{"c.r.a.p!", "crap!"},
+		{"c-r-a-p", "crap"},
+		{"W O O D", "wood"},
+		{"craaaap", "craap"},
+		{"shhhh, the baby's asleep", "shh, the baby's asleep"},
+		{"ｃｒａｐ", "crap"},        // full-width
+		{"сrар", "crap"},        // Cyrillic с, р and а
+		{"boo​gers", "boogers"}, // zero-width space
+		{"Crème brûlée", "creme brulee"},
+		{"l33t h4x0r", "leet haxor"},
+		{"@ll in!", "all in!"},
+		{"crap!", "crap!"},
+		{"room 101, floor 3", "room 101, floor 3"},
+		{"I have 3 pens", "i have 3 pens"},
+		{"a b", "a b"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if normalized := normalize(test.content).text; normalized != test.normalized {
+			t.Errorf("normalize(%q) = %q, want %q", test.content, normalized, test.normalized)
+		}
+	}
+}
+
+func TestNormalizeSpan(t *testing.T) {
+	tests := []struct {
+		content string
+
+		// word is a word of the normalized text, and original what it stands for in the content.
+		word     string
+		original string
+	}{
+		{"what c r a p", "crap", "c r a p"},
+		{"c.r.a.p!", "crap", "c.r.a.p"},
+		{"oh craaaap, again", "craap", "craaaap"},
+		{"ｃｒａｐ", "crap", "ｃｒａｐ"},
+		{"boo​gers!", "boogers", "boo​gers"},
+		{"Crème brûlée", "brulee", "brûlée"},
+	}
+
+	for _, test := range tests {
+		normalized := normalize(test.content)
+		i := strings.Index(normalized.text, test.word)
+		if i < 0 {
+			t.Errorf("normalize(%q) = %q, want it to hold %q", test.content, normalized.text, test.word)
+			continue
+		}
+
+		start, end := normalized.span(i, i+len(test.word))
+		if original := test.content[start:end]; original != test.original {
+			t.Errorf("normalize(%q): %q stands for %q, want %q", test.content, test.word, original, test.original)
+		}
+	}
+}
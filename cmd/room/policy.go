@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// profanityAction is what's done about a chat message holding profanities.
+// Actions are ordered from the most lenient to the strictest.
+type profanityAction int
+
+const (
+	// allowProfanity broadcasts the message as is.
+	allowProfanity profanityAction = iota
+
+	// maskProfanity broadcasts the message with the profanities masked with asterisks.
+	maskProfanity
+
+	// warnProfanity broadcasts the masked message, and warns the player privately.
+	warnProfanity
+
+	// blockProfanity drops the message, telling the player why.
+	blockProfanity
+)
+
+var profanityActions = map[string]profanityAction{
+	"allow": allowProfanity,
+	"mask":  maskProfanity,
+	"warn":  warnProfanity,
+	"block": blockProfanity,
+}
+
+// profanityPolicy maps the severity of profanities to what's done about them.
+type profanityPolicy map[Severity]profanityAction
+
+// defaultProfanityPolicy masks mild profanities, warns about moderate ones and blocks severe ones.
+var defaultProfanityPolicy = profanityPolicy{
+	Mild:     maskProfanity,
+	Moderate: warnProfanity,
+	Severe:   blockProfanity,
+}
+
+// newProfanityPolicy returns the policy set with PROFANITY_POLICY, as comma separated severity=action pairs
+// (e.g., "mild=mask,moderate=warn,severe=block"). Severities left out keep their default action.
+func newProfanityPolicy() profanityPolicy {
+	policy := make(profanityPolicy, len(defaultProfanityPolicy))
+	for severity, action := range defaultProfanityPolicy {
+		policy[severity] = action
+	}
+
+	value := os.Getenv("PROFANITY_POLICY")
+	if value == "" {
+		return policy
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("invalid profanity policy: %s", value))
+		}
+
+		severity := severityOf(strings.TrimSpace(parts[0]))
+		if severity == 0 {
+			panic(fmt.Sprintf("invalid profanity severity: %s", parts[0]))
+		}
+		action, ok := profanityActions[strings.ToLower(strings.TrimSpace(parts[1]))]
+		if !ok {
+			panic(fmt.Sprintf("invalid profanity action: %s", parts[1]))
+		}
+
+		policy[severity] = action
+	}
+
+	return policy
+}
+
+// Action returns what's done about a message holding the profanities, which is the strictest action
+// for any of them. Unknown severities are blocked.
+func (policy profanityPolicy) Action(matches []ProfanityMatch) profanityAction {
+	strictest := allowProfanity
+	for _, match := range matches {
+		action, ok := policy[match.Severity]
+		if !ok {
+			action = blockProfanity
+		}
+		if action > strictest {
+			strictest = action
+		}
+	}
+	return strictest
+}
+
+// maskProfanities replaces the profanities found in content with asterisks, keeping spaces
+// (e.g., "oh c r a p!" becomes "oh * * * *!").
+func maskProfanities(content string, matches []ProfanityMatch) string {
+	var masked bytes.Buffer
+	offset := 0
+	for _, match := range matches {
+		if match.Start < offset {
+			continue
+		}
+
+		masked.WriteString(content[offset:match.Start])
+		for _, r := range content[match.Start:match.End] {
+			if unicode.IsSpace(r) {
+				masked.WriteRune(r)
+			} else {
+				masked.WriteByte('*')
+			}
+		}
+		offset = match.End
+	}
+	masked.WriteString(content[offset:])
+
+	return masked.String()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"regexp"
@@ -17,22 +18,65 @@ import (
 //    \           /    \           /      /  /|\  \       /       \
 ////////////////////////////////////////////////////////////////////
 
-var profanities = []string{
-	"boogers",
-	"snot",
-	"poop",
-	"shucks",
-	"argh",
-	"dang",
-	"boob",
-	"crap",
-	"woo",
-	"merde",
+// Severity ranks how offensive a profanity is, which decides what's done about it (see profanityPolicy).
+type Severity int
+
+const (
+	Mild Severity = iota + 1
+	Moderate
+	Severe
+)
+
+var severityNames = map[Severity]string{
+	Mild:     "mild",
+	Moderate: "moderate",
+	Severe:   "severe",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+type profanity struct {
+	term     string
+	severity Severity
+}
+
+var profanities = []profanity{
+	{"boogers", Mild},
+	{"snot", Mild},
+	{"poop", Mild},
+	{"shucks", Mild},
+	{"argh", Mild},
+	{"dang", Mild},
+	{"boob", Moderate},
+	{"crap", Moderate},
+	{"woo", Mild},
+	{"merde", Severe},
+}
+
+// defaultAllowList holds known false positives, e.g. the dice game.
+var defaultAllowList = []string{
+	"craps",
+}
+
+// ProfanityMatch is a profanity found in content.
+type ProfanityMatch struct {
+	// Term is the profanity matched, and Severity how offensive it is.
+	Term     string
+	Severity Severity
+
+	// Start and End are the byte offsets of the match in the content, as written by the player.
+	Start int
+	End   int
 }
 
 type ProfanityChecker interface {
-	// Check if the provided content contains any profanities.
-	Check(content string) bool
+	// Check returns the profanities found in the provided content, in order of appearance.
+	Check(content string) []ProfanityMatch
 }
 
 func newProfanityChecker() ProfanityChecker {
@@ -42,34 +86,157 @@ func newProfanityChecker() ProfanityChecker {
 	case "", "v1":
 		return newDummyProfanityChecker()
 	case "v2":
-		return newRegexProfanityChecker()
+		if sources := os.Getenv("PROFANITY_LISTS"); sources != "" {
+			return newWordListChecker(sources)
+		}
+		return newProfanityMatcher(profanities, profanityAllowList())
 	default:
 		panic(fmt.Sprintf("unsupported service version: %s", version))
 	}
 }
 
+// newProfanityMatcher returns a checker matching the profanities, set with PROFANITY_MATCHER: either "automaton"
+// (the default), which scans messages in the same time whatever the number of profanities, or "regex".
+func newProfanityMatcher(profanities []profanity, allowList []string) ProfanityChecker {
+	matcher := strings.ToLower(os.Getenv("PROFANITY_MATCHER"))
+
+	switch matcher {
+	case "", "automaton":
+		return newAutomatonProfanityChecker(profanities, allowList)
+	case "regex":
+		return newRegexProfanityChecker(profanities, allowList)
+	default:
+		panic(fmt.Sprintf("unsupported profanity matcher: %s", matcher))
+	}
+}
+
 type dummyProfanityChecker struct{}
 
 func newDummyProfanityChecker() *dummyProfanityChecker {
 	return &dummyProfanityChecker{}
 }
 
-func (c *dummyProfanityChecker) Check(content string) bool {
-	return false
+func (c *dummyProfanityChecker) Check(content string) []ProfanityMatch {
+	return nil
 }
 
+// nonWordChar matches a character which isn't part of a word, the same as isWordChar (the regular expressions'
+// \b only knows of ASCII words).
+const nonWordChar = `[^\p{L}\p{Nd}_]`
+
+// regexProfanityChecker matches profanities as whole words of the normalized text (see normalize),
+// allowing for their plural and for repeated characters (e.g., "craaap").
+// Words on the allow-list are never reported, even when they match.
 type regexProfanityChecker struct {
-	re *regexp.Regexp
+	// re has a group for the word matched, and then a group per profanity, in the order of profanities,
+	// telling which one matched.
+	re          *regexp.Regexp
+	profanities []profanity
+	allowed     map[string]bool
 }
 
-func newRegexProfanityChecker() *regexProfanityChecker {
-	regex := fmt.Sprintf("(%s)", strings.Join(profanities, "|"))
+func newRegexProfanityChecker(profanities []profanity, allowList []string) *regexProfanityChecker {
+	patterns := make([]string, 0, len(profanities))
+	for _, p := range profanities {
+		patterns = append(patterns, fmt.Sprintf("(%s)", profanityPattern(p.term)))
+	}
+
+	regex := fmt.Sprintf(`(?:^|%[1]s)((?:%[2]s)(?:e?s)?)(?:$|%[1]s)`, nonWordChar, strings.Join(patterns, "|"))
 	return &regexProfanityChecker{
-		re: regexp.MustCompile(regex),
+		re:          regexp.MustCompile(regex),
+		profanities: profanities,
+		allowed:     allowedWords(allowList),
+	}
+}
+
+func (c *regexProfanityChecker) Check(content string) []ProfanityMatch {
+	normalized := normalize(content)
+
+	// Each search picks up after the previous word rather than after the character ending it, which may begin
+	// the next word. Profanities begin with a word character, so that a search doesn't take its start for one.
+	var matches []ProfanityMatch
+	for offset := 0; offset < len(normalized.text); {
+		loc := c.re.FindStringSubmatchIndex(normalized.text[offset:])
+		if loc == nil {
+			break
+		}
+		wordStart, wordEnd := offset+loc[2], offset+loc[3]
+		offset = wordEnd
+
+		if c.allowed[squeezeRepeats(normalized.text[wordStart:wordEnd])] {
+			continue
+		}
+
+		for i, p := range c.profanities {
+			if loc[4+2*i] < 0 {
+				continue
+			}
+
+			start, end := normalized.span(wordStart, wordEnd)
+			matches = append(matches, ProfanityMatch{
+				Term:     p.term,
+				Severity: p.severity,
+				Start:    start,
+				End:      end,
+			})
+			break
+		}
+	}
+	return matches
+}
+
+// profanityPattern returns a regular expression matching the profanity in normalized text,
+// where each character may be repeated (e.g., "poop" matches "pooop", but not "pop").
+func profanityPattern(profanity string) string {
+	runes := []rune(normalize(profanity).text)
+
+	var pattern bytes.Buffer
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+
+		quoted := regexp.QuoteMeta(string(runes[i]))
+		pattern.WriteString(strings.Repeat(quoted, j-i))
+		pattern.WriteString("+")
+		i = j
+	}
+
+	return pattern.String()
+}
+
+// allowedWords returns the set of words on the allow-list, in the form matches are looked up by:
+// normalized, with repeats squeezed (see squeezeRepeats).
+func allowedWords(allowList []string) map[string]bool {
+	allowed := make(map[string]bool, len(allowList))
+	for _, word := range allowList {
+		allowed[squeezeRepeats(normalize(word).text)] = true
 	}
+	return allowed
 }
 
-func (c *regexProfanityChecker) Check(content string) bool {
-	lowercased := strings.ToLower(content)
-	return c.re.MatchString(lowercased)
+// squeezeRepeats reduces every run of a character to a single one, so that allowed words are recognized whatever
+// the repeats (e.g., "craaaps" is "craps"), which normalized text caps rather than removes.
+func squeezeRepeats(text string) string {
+	var squeezed bytes.Buffer
+	var last rune
+	for i, r := range text {
+		if i == 0 || r != last {
+			squeezed.WriteRune(r)
+		}
+		last = r
+	}
+	return squeezed.String()
+}
+
+// profanityAllowList returns the words never reported as profanities, in spite of matching one,
+// from the comma separated PROFANITY_ALLOW_LIST (defaulting to defaultAllowList).
+func profanityAllowList() []string {
+	value := os.Getenv("PROFANITY_ALLOW_LIST")
+	if value == "" {
+		return defaultAllowList
+	}
+
+	return splitList(value)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// profanityTests are chat messages, along with the profanities in them as written by the player.
+var profanityTests = []struct {
+	content string
+	matches []string
+}{
+	// Words holding a profanity, or a profanity holding words, are fine
+	{"This wood is wooden, danger!", nil},
+	{"I'm a bit snotty today", nil},
+	{"Woohoo, we won", nil},
+	{"The boob tube is on", []string{"boob"}},
+
+	// Tricks to sneak profanities past the filter
+	{"p00p happens", []string{"p00p"}},
+	{"what c r a p", []string{"c r a p"}},
+	{"c.r.a.p!", []string{"c.r.a.p"}},
+	{"oh craaaap, again", []string{"craaaap"}},
+	{"ｃｒａｐ", []string{"ｃｒａｐ"}},
+	{"this is сrар", []string{"сrар"}},
+	{"boo​gers everywhere", []string{"boo​gers"}},
+	{"Argh, MERDE alors", []string{"Argh", "MERDE"}},
+	{"dangs and poops", []string{"dangs", "poops"}},
+
+	// Profanities are matched as written, punctuation aside
+	{"crap!", []string{"crap"}},
+	{"well... crap.", []string{"crap"}},
+
+	// Repeats must be there, as in the profanity
+	{"pop goes the weasel", nil},
+	{"booger", nil},
+
+	// The allow-list, whatever the repeats
+	{"Anyone for craps?", nil},
+	{"CRAPS tonight", nil},
+	{"craaaps, I lost", nil},
+}
+
+// newTestProfanityCheckers returns each kind of checker, matching the built-in profanities.
+func newTestProfanityCheckers() map[string]ProfanityChecker {
+	return map[string]ProfanityChecker{
+		"regex":     newRegexProfanityChecker(profanities, defaultAllowList),
+		"automaton": newAutomatonProfanityChecker(profanities, defaultAllowList),
+	}
+}
+
+func TestProfanityCheckers(t *testing.T) {
+	checkers := newTestProfanityCheckers()
+
+	for name, checker := range checkers {
+		for _, test := range profanityTests {
+			var matched []string
+			for _, match := range checker.Check(test.content) {
+				matched = append(matched, test.content[match.Start:match.End])
+			}
+
+			if !reflect.DeepEqual(matched, test.matches) {
+				t.Errorf("%s: Check(%q) matched %q, want %q", name, test.content, matched, test.matches)
+			}
+		}
+	}
+}
+
+func TestProfanityMatchTerm(t *testing.T) {
+	checkers := newTestProfanityCheckers()
+
+	want := []ProfanityMatch{
+		{Term: "woo", Severity: Mild, Start: 0, End: 4},
+		{Term: "crap", Severity: Moderate, Start: 11, End: 18},
+		{Term: "merde", Severity: Severe, Start: 20, End: 25},
+	}
+
+	for name, checker := range checkers {
+		if matches := checker.Check("Wooo, what c r a p, merde"); !reflect.DeepEqual(matches, want) {
+			t.Errorf("%s: Check() = %+v, want %+v", name, matches, want)
+		}
+	}
+}
+
+func TestProfanityAllowList(t *testing.T) {
+	allowList := []string{"Boogers", "p00ps"}
+	checker := newRegexProfanityChecker(profanities, allowList)
+
+	tests := []struct {
+		content string
+		matched bool
+	}{
+		{"boogers", false},
+		{"BOOOGERS", false},
+		{"poops", false},
+		{"poop", true},
+		{"craps", true},
+	}
+
+	for _, test := range tests {
+		if matched := len(checker.Check(test.content)) > 0; matched != test.matched {
+			t.Errorf("Check(%q) matched = %v, want %v", test.content, matched, test.matched)
+		}
+	}
+}
+
+func TestSqueezeRepeats(t *testing.T) {
+	tests := []struct {
+		text     string
+		squeezed string
+	}{
+		{"craaps", "craps"},
+		{"craps", "craps"},
+		{"boogers", "bogers"},
+		{"сrар", "сrар"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if squeezed := squeezeRepeats(test.text); squeezed != test.squeezed {
+			t.Errorf("squeezeRepeats(%q) = %q, want %q", test.text, squeezed, test.squeezed)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const (
+	pushBufferSize        = 256
+	pushHeartbeatInterval = 15 * time.Second
+)
+
+type pushEntry struct {
+	seq int64
+	msg gameon.Message
+}
+
+// pushHub streams messages the room sends on its own (rather than in response to a request)
+// as server-sent events, for the mediator to dispatch.
+//
+// Event IDs are of the form <epoch>-<seq>, where the epoch identifies the hub instance.
+// A subscriber reconnecting with the Last-Event-ID header resumes right after that event,
+// as long as it is still buffered. New subscribers, and subscribers coming from another epoch (e.g., the room
+// service restarted), get messages published from then on: the buffered ones were never meant for them.
+type pushHub struct {
+	epoch string
+
+	// buffer holds the most recently published messages, oldest first.
+	buffer []pushEntry
+	seq    int64
+
+	// notify is closed (and replaced) whenever messages are published.
+	notify chan struct{}
+
+	// closed is closed when the hub shuts down, ending every stream.
+	closed chan struct{}
+
+	mutex sync.Mutex
+}
+
+func newPushHub() *pushHub {
+	return &pushHub{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		notify: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Close ends every stream, so that the subscribers reconnect (to another instance, if this one is going away).
+func (h *pushHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	select {
+	case <-h.closed:
+	default:
+		close(h.closed)
+	}
+}
+
+// Publish queues messages for delivery to subscribers.
+func (h *pushHub) Publish(msgs ...gameon.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, msg := range msgs {
+		h.seq++
+		h.buffer = append(h.buffer, pushEntry{seq: h.seq, msg: msg})
+	}
+	if overflow := len(h.buffer) - pushBufferSize; overflow > 0 {
+		h.buffer = append([]pushEntry(nil), h.buffer[overflow:]...)
+	}
+
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+// since returns the buffered entries after the given sequence number,
+// along with a channel closed when further messages are published.
+func (h *pushHub) since(seq int64) ([]pushEntry, <-chan struct{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var entries []pushEntry
+	for _, entry := range h.buffer {
+		if entry.seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, h.notify
+}
+
+// resumeFrom parses a Last-Event-ID header into the sequence number to resume after.
+// Subscribers without a valid Last-Event-ID for this epoch start with the next published message.
+func (h *pushHub) resumeFrom(lastEventID string) int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	parts := strings.SplitN(lastEventID, "-", 2)
+	if len(parts) != 2 || parts[0] != h.epoch {
+		return h.seq
+	}
+
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seq > h.seq {
+		return h.seq
+	}
+
+	return seq
+}
+
+func (h *pushHub) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	seq := h.resumeFrom(req.Header.Get("Last-Event-ID"))
+	logrus.Infof("Push subscriber %s connected, resuming after event %d", req.RemoteAddr, seq)
+
+	heartbeat := time.NewTicker(pushHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	disconnected := req.Context().Done()
+	for {
+		entries, notify := h.since(seq)
+		for _, entry := range entries {
+			_, err := fmt.Fprintf(resp, "id: %s-%d\nevent: message\ndata: %s\n\n", h.epoch, entry.seq, jsonMarshal(entry.msg))
+			if err != nil {
+				return
+			}
+			seq = entry.seq
+		}
+		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(resp, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case <-disconnected:
+			logrus.Infof("Push subscriber %s disconnected", req.RemoteAddr)
+			return
+		case <-h.closed:
+			return
+		}
+	}
+}
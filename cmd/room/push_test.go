@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func TestPushHubResumeFrom(t *testing.T) {
+	h := newPushHub()
+	h.Publish(gameon.Message{Direction: "player", Recipient: "*"}, gameon.Message{Direction: "player", Recipient: "*"})
+
+	tests := []struct {
+		lastEventID string
+		seq         int64
+	}{
+		{"", 2},
+		{fmt.Sprintf("%s-1", h.epoch), 1},
+		{fmt.Sprintf("%s-0", h.epoch), 0},
+		{"otherepoch-1", 2},
+		{fmt.Sprintf("%s-x", h.epoch), 2},
+		{fmt.Sprintf("%s-7", h.epoch), 2},
+		{"garbage", 2},
+	}
+
+	for _, test := range tests {
+		if seq := h.resumeFrom(test.lastEventID); seq != test.seq {
+			t.Errorf("resumeFrom(%q) = %d, want %d", test.lastEventID, seq, test.seq)
+		}
+	}
+}
@@ -5,24 +5,48 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gameontext/a8-room/pkg/env"
 	"github.com/gameontext/a8-room/pkg/gameon"
 )
 
-var exits = map[string]string{
-	"N": "An old wooden door with a large arrow carved on its center",
-	"S": "A heavy metal door with signs of rust",
-	"W": "A gray, plain looking door",
-	"E": "A door surrounded by a mysterious glow along it edges",
-}
-
+// room is the room service. It hosts one or more rooms, each with its own definition and roster.
 type room struct {
 	profanityChecker ProfanityChecker
+	profanityPolicy  profanityPolicy
+	strikes          *strikes
+	push             *pushHub
+	commands         *commandRegistry
+	inventories      *inventories
+
+	// defs maps room IDs to their definitions. The definition keyed by an empty ID, if any,
+	// serves every room ID without a definition of its own.
+	defs map[string]*roomDefinition
+
+	// rooms maps room IDs to the state of the hosted rooms, created on the first request for each room.
+	rooms map[string]*hostedRoom
+
+	// maxFallbackRooms bounds the number of rooms served by the definition without an ID.
+	maxFallbackRooms int
+
+	presenceTTL time.Duration
+	mutex       sync.RWMutex
 }
 
-func newRoom() *room {
+func newRoom(defs map[string]*roomDefinition) *room {
 	return &room{
 		profanityChecker: newProfanityChecker(),
+		profanityPolicy:  newProfanityPolicy(),
+		strikes:          newStrikes(),
+		push:             newPushHub(),
+		commands:         newCommandRegistry(builtinCommands()...),
+		inventories:      newInventories(),
+		defs:             defs,
+		rooms:            make(map[string]*hostedRoom),
+		maxFallbackRooms: env.PositiveInt("MAX_FALLBACK_ROOMS", defaultMaxFallbackRooms),
+		presenceTTL:      presenceTTL(),
 	}
 }
 
@@ -41,33 +65,60 @@ func (r *room) hello(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	location := gameon.Message{
-		Direction: "player",
-		Recipient: hello.UserID,
-		Payload: jsonMarshal(gameon.Location{
-			Type:        "location",
-			Name:        "Chatter",
-			FullName:    "A chat room",
-			Description: "a darkly lit room, there are people here, some are walking around, some are standing in groups",
-			Exits:       exits,
-			Commands:    map[string]string{},
-			Inventory:   []string{},
-		}),
+	hosted, def := r.lookup(req.Header.Get(gameon.RoomIDHeader))
+	if hosted == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	welcome := gameon.Message{
-		Direction: "player",
-		Recipient: "*",
-		Payload: jsonMarshal(gameon.Event{
-			Type: "event",
-			Content: map[string]string{
-				hello.UserID: "Welcome!",
-				"*":          fmt.Sprintf("%s has just entered the room", hello.Username),
-			},
-		}),
+	r.enter(hosted, hello.UserInfo)
+	writeResponseMessages(resp, r.location(hosted, def, hello.UserID), hosted.welcome(hello.UserInfo))
+}
+
+func (r *room) join(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var join gameon.Join
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&join)
+
+	if err != nil || join.UserID == "" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	hosted, def := r.lookup(req.Header.Get(gameon.RoomIDHeader))
+	if hosted == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// The player is already in the room, so only the location is sent back, without a welcome broadcast.
+	// The roster is refreshed all the same, in case the player expired while disconnected.
+	r.enter(hosted, join.UserInfo)
+	writeResponseMessages(resp, r.location(hosted, def, join.UserID))
+}
+
+func (r *room) part(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
 
-	writeResponseMessages(resp, location, welcome)
+	var part gameon.Part
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&part)
+
+	if err != nil || part.UserID == "" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The player didn't leave the room, only its connection went away, so there's nobody to notify
+	writeResponseMessages(resp)
 }
 
 func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
@@ -85,6 +136,16 @@ func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	hosted, _ := r.lookup(req.Header.Get(gameon.RoomIDHeader))
+	if hosted == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// The player's items stay behind
+	hosted.roster.Leave(goodbye.UserID)
+	r.dropAll(hosted, goodbye.UserID)
+
 	farewell := gameon.Message{
 		Direction: "player",
 		Recipient: "*",
@@ -95,6 +156,7 @@ func (r *room) goodbye(resp http.ResponseWriter, req *http.Request) {
 				"*":            fmt.Sprintf("%s has left the room", goodbye.Username),
 			},
 		}),
+		Room: hosted.id,
 	}
 
 	writeResponseMessages(resp, farewell)
@@ -114,96 +176,93 @@ func (r *room) room(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	hosted, def := r.lookup(req.Header.Get(gameon.RoomIDHeader))
+	if hosted == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hosted.roster.Seen(command.UserID)
+
 	if strings.HasPrefix(command.Content, "/") {
 		// slash command
-		r.handleSlash(command, resp)
+		r.handleSlash(hosted, def, command, resp)
 	} else {
 		// chat command
-		r.handleChat(command, resp)
+		r.handleChat(hosted, def, command, resp)
 	}
 }
 
-func (r *room) handleSlash(command gameon.RoomCommand, resp http.ResponseWriter) {
+func (r *room) handleSlash(hosted *hostedRoom, def *roomDefinition, command gameon.RoomCommand, resp http.ResponseWriter) {
 	words := strings.Fields(command.Content)
-	commandName := strings.ToLower(words[0])
-
-	var eventContent string
-	switch commandName {
-	case "/go":
-		if len(words) < 2 {
-			eventContent = "Go where?"
-			break
-		}
-
-		exitID := strings.ToUpper(words[1])
-		if _, ok := exits[exitID]; !ok {
-			eventContent = "You probably don't wanna go there..."
-			break
-		}
-
-		location := gameon.Message{
-			Direction: "playerLocation",
-			Recipient: command.UserID,
-			Payload: jsonMarshal(gameon.PlayerLocation{
-				Type:    "exit",
-				Content: "You frantically run towards the exit",
-				ExitID:  exitID,
-			}),
-		}
-		writeResponseMessages(resp, location)
-		return
 
-	case "/examine":
-		eventContent = "Shouldn't you be mingling?"
-	case "/inventory":
-		eventContent = "There is nothing here"
-	case "/look":
-		eventContent = "It's just a room"
-	default:
-		eventContent = fmt.Sprintf("Don't know how to %s", commandName[1:])
+	call := &commandCall{
+		UserInfo: command.UserInfo,
+		hosted:   hosted,
+		def:      def,
+		name:     strings.ToLower(words[0]),
+		args:     words[1:],
 	}
+	writeResponseMessages(resp, r.commands.Dispatch(r, call)...)
+}
 
-	event := gameon.Message{
-		Direction: "player",
-		Recipient: command.UserID,
-		Payload: jsonMarshal(gameon.Event{
-			Type: "event",
-			Content: map[string]string{
-				command.UserID: eventContent,
-			},
-		}),
+func (r *room) handleChat(hosted *hostedRoom, def *roomDefinition, command gameon.RoomCommand, resp http.ResponseWriter) {
+	if left := r.strikes.Muted(command.UserID); left > 0 {
+		writeResponseMessages(resp, privateEvent(hosted, command.UserID,
+			fmt.Sprintf("You are muted for another %s", roundUpToSecond(left))))
+		return
 	}
-	writeResponseMessages(resp, event)
-}
 
-func (r *room) handleChat(command gameon.RoomCommand, resp http.ResponseWriter) {
-	var msg gameon.Message
+	matches := r.profanityChecker.Check(command.Content)
+	action := r.profanityPolicy.Action(matches)
 
-	dirty := r.profanityChecker.Check(command.Content)
-	if dirty {
-		msg = gameon.Message{
-			Direction: "player",
-			Recipient: command.UserID,
-			Payload: jsonMarshal(gameon.Event{
-				Type: "event",
-				Content: map[string]string{
-					command.UserID: "Pardon your french!",
-				},
-			}),
-		}
+	var messages []gameon.Message
+	if action == blockProfanity {
+		messages = append(messages, privateEvent(hosted, command.UserID, "Pardon your french!"))
 	} else {
-		msg = gameon.Message{
+		content := command.Content
+		if action != allowProfanity {
+			content = maskProfanities(content, matches)
+		}
+
+		messages = append(messages, gameon.Message{
 			Direction: "player",
 			Recipient: "*",
 			Payload: jsonMarshal(gameon.Chat{
 				Type:     "chat",
 				Username: command.Username,
-				Content:  command.Content,
+				Content:  content,
 			}),
+			Room: hosted.id,
+		})
+
+		if action == warnProfanity {
+			messages = append(messages, privateEvent(hosted, command.UserID,
+				fmt.Sprintf("Mind your language! Your message went out as: %s", content)))
 		}
 	}
 
-	writeResponseMessages(resp, msg)
+	// Masked words are tolerated, anything worse counts as a strike
+	if action >= warnProfanity {
+		messages = append(messages, r.strike(hosted, def, command.UserInfo)...)
+	}
+
+	writeResponseMessages(resp, messages...)
+}
+
+// privateEvent returns an event for the player's eyes only.
+func privateEvent(hosted *hostedRoom, userID, content string) gameon.Message {
+	return gameon.Message{
+		Direction: "player",
+		Recipient: userID,
+		Payload: jsonMarshal(gameon.Event{
+			Type: "event",
+			Content: map[string]string{
+				userID: content,
+			},
+		}),
+		Room: hosted.id,
+	}
 }
 
 func writeResponseMessages(resp http.ResponseWriter, messages ...gameon.Message) {
@@ -216,6 +275,13 @@ func writeResponseMessages(resp http.ResponseWriter, messages ...gameon.Message)
 	resp.Write(bytes)
 }
 
+// writeJSON writes the value as a JSON response.
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(jsonMarshal(v))
+}
+
 func jsonMarshal(obj interface{}) []byte {
 	bytes, _ := json.Marshal(obj)
 	return bytes
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const defaultPresenceTTL = time.Hour
+
+// presence records a player present in the room.
+type presence struct {
+	gameon.UserInfo
+
+	// since is when the player entered the room, and lastSeen when the player was last heard of.
+	since    time.Time
+	lastSeen time.Time
+}
+
+// roster keeps track of the players present in the room.
+// Players are added on hello (or join), removed on goodbye, and expire when not heard of for a while,
+// in case their goodbye never arrives.
+type roster struct {
+	players map[string]*presence
+	ttl     time.Duration
+
+	now   func() time.Time
+	mutex sync.RWMutex
+}
+
+// presenceTTL returns how long players not heard of stay in the room, set with PRESENCE_TTL.
+func presenceTTL() time.Duration {
+	return env.PositiveDuration("PRESENCE_TTL", defaultPresenceTTL)
+}
+
+func newRoster(ttl time.Duration) *roster {
+	return &roster{
+		players: make(map[string]*presence),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// Enter adds the player to the roster, and reports whether the player wasn't present already.
+func (r *roster) Enter(userInfo gameon.UserInfo) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	if p, ok := r.players[userInfo.UserID]; ok {
+		p.Username = userInfo.Username
+		p.lastSeen = now
+		return false
+	}
+
+	r.players[userInfo.UserID] = &presence{
+		UserInfo: userInfo,
+		since:    now,
+		lastSeen: now,
+	}
+	return true
+}
+
+// Leave removes the player from the roster, and reports whether the player was present.
+func (r *roster) Leave(userID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.players[userID]
+	delete(r.players, userID)
+	return ok
+}
+
+// Seen records activity from a present player, postponing its expiry.
+func (r *roster) Seen(userID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if p, ok := r.players[userID]; ok {
+		p.lastSeen = r.now()
+	}
+}
+
+// Present returns the players in the room, in order of arrival.
+func (r *roster) Present() []presence {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	players := make([]presence, 0, len(r.players))
+	for _, p := range r.players {
+		players = append(players, *p)
+	}
+
+	sort.Sort(byArrival(players))
+	return players
+}
+
+// Count returns the number of players in the room.
+func (r *roster) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.players)
+}
+
+// Expire removes the players not heard of for longer than the TTL, and returns them.
+func (r *roster) Expire() []presence {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var expired []presence
+	now := r.now()
+	for userID, p := range r.players {
+		if now.Sub(p.lastSeen) > r.ttl {
+			expired = append(expired, *p)
+			delete(r.players, userID)
+		}
+	}
+
+	return expired
+}
+
+type byArrival []presence
+
+func (s byArrival) Len() int           { return len(s) }
+func (s byArrival) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byArrival) Less(i, j int) bool { return s[i].since.Before(s[j].since) }
+
+// expirePresence periodically drops the players whose goodbye never arrived,
+// letting everyone else in the room know over the push channel.
+func (r *room) expirePresence() {
+	for range time.Tick(r.presenceTTL / 4) {
+		for _, hosted := range r.hostedRooms() {
+			for _, p := range hosted.roster.Expire() {
+				logrus.Infof("Player %s (%s) expired from room %s", p.UserID, p.Username, hosted.id)
+				r.dropAll(hosted, p.UserID)
+
+				r.push.Publish(gameon.Message{
+					Direction: "player",
+					Recipient: "*",
+					Payload: jsonMarshal(gameon.Event{
+						Type: "event",
+						Content: map[string]string{
+							"*": fmt.Sprintf("%s has wandered off", p.Username),
+						},
+					}),
+					Room: hosted.id,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+const (
+	defaultStrikeWindow = 15 * time.Minute
+	defaultMuteDuration = 5 * time.Minute
+	defaultMuteAfter    = 3
+	defaultKickAfter    = 5
+
+	// minStrikesPrune is the number of players with records strikes are first pruned at (see prune).
+	minStrikesPrune = 64
+)
+
+// penalty is what befalls a player on a profanity strike.
+type penalty int
+
+const (
+	// warnPlayer tells the player about the strike.
+	warnPlayer penalty = iota
+
+	// mutePlayer refuses the player's chat for a while.
+	mutePlayer
+
+	// kickPlayer throws the player out of the room.
+	kickPlayer
+)
+
+// strikes keeps track of the profanity strikes of each player over a sliding window,
+// escalating penalties as they add up: a warning, then a timed mute, then a kick.
+// A kick settles the player's strikes, which are cleared so that a player coming back starts over.
+type strikes struct {
+	// window is how long strikes count for.
+	window time.Duration
+
+	// muteAfter and kickAfter are the number of strikes within the window players are muted and kicked at.
+	muteAfter    int
+	kickAfter    int
+	muteDuration time.Duration
+
+	players map[string]*strikeRecord
+	now     func() time.Time
+	mutex   sync.Mutex
+
+	// pruneAt is the number of players with records the next prune happens at.
+	pruneAt int
+}
+
+type strikeRecord struct {
+	strikes    []time.Time
+	mutedUntil time.Time
+}
+
+// strikeStatus is the state of a player's strikes, as shown to moderators.
+type strikeStatus struct {
+	UserID     string     `json:"userId"`
+	Strikes    int        `json:"strikes"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+}
+
+// newStrikes returns strikes set with STRIKE_WINDOW, STRIKE_MUTE_AFTER, STRIKE_MUTE_DURATION and STRIKE_KICK_AFTER.
+func newStrikes() *strikes {
+	s := &strikes{
+		window:       env.PositiveDuration("STRIKE_WINDOW", defaultStrikeWindow),
+		muteAfter:    env.PositiveInt("STRIKE_MUTE_AFTER", defaultMuteAfter),
+		kickAfter:    env.PositiveInt("STRIKE_KICK_AFTER", defaultKickAfter),
+		muteDuration: env.PositiveDuration("STRIKE_MUTE_DURATION", defaultMuteDuration),
+		players:      make(map[string]*strikeRecord),
+		now:          time.Now,
+		pruneAt:      minStrikesPrune,
+	}
+
+	if s.kickAfter < s.muteAfter {
+		panic(fmt.Sprintf("invalid strikes: players are kicked (%d) before being muted (%d)", s.kickAfter, s.muteAfter))
+	}
+
+	return s
+}
+
+// Strike records a profanity strike against the player, and returns the penalty for it
+// along with the number of strikes within the window.
+func (s *strikes) Strike(userID string) (penalty, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if len(s.players) >= s.pruneAt {
+		s.prune(now)
+	}
+
+	record := s.record(userID, now)
+	record.strikes = append(record.strikes, now)
+
+	count := len(record.strikes)
+	switch {
+	case count >= s.kickAfter:
+		return kickPlayer, count
+	case count >= s.muteAfter:
+		record.mutedUntil = now.Add(s.muteDuration)
+		return mutePlayer, count
+	default:
+		return warnPlayer, count
+	}
+}
+
+// Muted returns how long the player remains muted, or 0 if the player isn't.
+func (s *strikes) Muted(userID string) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.players[userID]; !ok {
+		return 0
+	}
+
+	now := s.now()
+	record := s.record(userID, now)
+	if record.expired(now) {
+		delete(s.players, userID)
+		return 0
+	}
+
+	left := record.mutedUntil.Sub(now)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// mute mutes the player, whatever the number of strikes.
+func (s *strikes) mute(userID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.record(userID, now).mutedUntil = now.Add(s.muteDuration)
+}
+
+// Reset forgives the player's strikes, lifting any mute, and reports whether the player had any.
+func (s *strikes) Reset(userID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.players[userID]
+	delete(s.players, userID)
+	return ok
+}
+
+// Status returns the strikes of every player with strikes within the window, or still muted.
+func (s *strikes) Status() []strikeStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.prune(now)
+
+	statuses := make([]strikeStatus, 0, len(s.players))
+	for userID, record := range s.players {
+		status := strikeStatus{UserID: userID, Strikes: len(record.strikes)}
+		if record.mutedUntil.After(now) {
+			mutedUntil := record.mutedUntil
+			status.MutedUntil = &mutedUntil
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Sort(byUserID(statuses))
+	return statuses
+}
+
+// prune drops the records of the players without strikes within the window, who aren't muted either.
+// Records are pruned whenever the number of players with records doubled since, so that players who got a strike
+// once don't stay around forever. The caller must hold the lock.
+func (s *strikes) prune(now time.Time) {
+	for userID := range s.players {
+		if s.record(userID, now).expired(now) {
+			delete(s.players, userID)
+		}
+	}
+
+	s.pruneAt = 2 * len(s.players)
+	if s.pruneAt < minStrikesPrune {
+		s.pruneAt = minStrikesPrune
+	}
+}
+
+// expired reports whether the record, with the strikes out of the window dropped, no longer holds anything.
+func (r *strikeRecord) expired(now time.Time) bool {
+	return len(r.strikes) == 0 && !r.mutedUntil.After(now)
+}
+
+// record returns the player's record, with the strikes out of the window dropped.
+// The caller must hold the lock.
+func (s *strikes) record(userID string, now time.Time) *strikeRecord {
+	record, ok := s.players[userID]
+	if !ok {
+		record = &strikeRecord{}
+		s.players[userID] = record
+	}
+
+	i := 0
+	for i < len(record.strikes) && now.Sub(record.strikes[i]) >= s.window {
+		i++
+	}
+	record.strikes = record.strikes[i:]
+
+	return record
+}
+
+// ServeHTTP lets moderators see the players' strikes (GET, optionally for a single userId),
+// and reset a player's strikes (DELETE with a userId).
+func (s *strikes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userId")
+
+	switch r.Method {
+	case "GET":
+		statuses := s.Status()
+		if userID != "" {
+			status := strikeStatus{UserID: userID}
+			for _, st := range statuses {
+				if st.UserID == userID {
+					status = st
+				}
+			}
+			writeJSON(w, status)
+			return
+		}
+		writeJSON(w, statuses)
+	case "DELETE":
+		if userID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		logrus.Infof("Resetting strikes of player %s", userID)
+		if !s.Reset(userID) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type byUserID []strikeStatus
+
+func (s byUserID) Len() int           { return len(s) }
+func (s byUserID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byUserID) Less(i, j int) bool { return s[i].UserID < s[j].UserID }
+
+// strike records a profanity strike against the player, and returns the messages carrying out the penalty.
+func (r *room) strike(hosted *hostedRoom, def *roomDefinition, userInfo gameon.UserInfo) []gameon.Message {
+	penalty, count := r.strikes.Strike(userInfo.UserID)
+
+	if penalty == kickPlayer {
+		if exitID := r.kickExit(def); exitID != "" {
+			logrus.Warnf("Kicking player %s out of room %s after %d strikes", userInfo.UserID, hosted.id, count)
+			r.strikes.Reset(userInfo.UserID)
+			return []gameon.Message{
+				{
+					Direction: "player",
+					Recipient: "*",
+					Payload: jsonMarshal(gameon.Event{
+						Type: "event",
+						Content: map[string]string{
+							"*": fmt.Sprintf("%s is thrown out of the room for foul language", userInfo.Username),
+						},
+					}),
+					Room: hosted.id,
+				},
+				{
+					Direction: "playerLocation",
+					Recipient: userInfo.UserID,
+					Payload: jsonMarshal(gameon.PlayerLocation{
+						Type:    "exit",
+						Content: "That's enough! You are thrown out of the room",
+						ExitID:  exitID,
+					}),
+					Room: hosted.id,
+				},
+			}
+		}
+
+		// Players can't be kicked out of rooms without exits, so they're muted instead
+		r.strikes.mute(userInfo.UserID)
+		penalty = mutePlayer
+	}
+
+	if penalty == mutePlayer {
+		logrus.Infof("Muting player %s for %s after %d strikes", userInfo.UserID, r.strikes.muteDuration, count)
+		return []gameon.Message{privateEvent(hosted, userInfo.UserID,
+			fmt.Sprintf("That's strike %d! You are muted for %s", count, r.strikes.muteDuration))}
+	}
+
+	return []gameon.Message{privateEvent(hosted, userInfo.UserID,
+		fmt.Sprintf("That's strike %d! Keep it clean, or you'll be muted", count))}
+}
+
+// roundUpToSecond rounds the duration up to the second, so that players muted for a split second more
+// aren't told they're muted for another 0s.
+func roundUpToSecond(d time.Duration) time.Duration {
+	return (d + time.Second - 1) / time.Second * time.Second
+}
+
+// kickExit returns the exit players are kicked out of the room through: the kick exit of the definition if set,
+// or else the first exit in alphabetical order, preferably one leaving the room service so that players don't
+// end up in another of its rooms. It returns an empty string if the room has no exits.
+func (r *room) kickExit(def *roomDefinition) string {
+	if def.KickExit != "" {
+		return def.KickExit
+	}
+
+	exitIDs := make([]string, 0, len(def.Exits))
+	for exitID := range def.Exits {
+		exitIDs = append(exitIDs, exitID)
+	}
+	sort.Strings(exitIDs)
+
+	for _, exitID := range exitIDs {
+		if !r.hosts(def.Exits[exitID].Target) {
+			return exitID
+		}
+	}
+
+	if len(exitIDs) == 0 {
+		return ""
+	}
+	return exitIDs[0]
+}
+
+// moderatorOnly returns a handler accepting only requests bearing the moderator secret, set with MODERATOR_SECRET.
+// It returns nil when the secret isn't set, in which case moderation is disabled.
+func moderatorOnly(handler http.Handler) http.Handler {
+	secret := os.Getenv("MODERATOR_SECRET")
+	if secret == "" {
+		logrus.Warnf("MODERATOR_SECRET is not set, moderation endpoints are disabled")
+		return nil
+	}
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			logrus.Errorf("Rejecting %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gameontext/a8-room/pkg/gameon"
+)
+
+func TestStrikesEscalate(t *testing.T) {
+	s := newStrikes()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	want := []penalty{warnPlayer, warnPlayer, mutePlayer, mutePlayer, kickPlayer}
+	for i, p := range want {
+		if got, count := s.Strike("u1"); got != p || count != i+1 {
+			t.Errorf("strike %d: Strike() = %d, %d, want %d, %d", i+1, got, count, p, i+1)
+		}
+	}
+
+	// Strikes out of the window no longer count
+	now = now.Add(s.window)
+	if got, count := s.Strike("u1"); got != warnPlayer || count != 1 {
+		t.Errorf("Strike() after the window = %d, %d, want a warning and 1 strike", got, count)
+	}
+}
+
+func TestKickClearsStrikes(t *testing.T) {
+	r := newRoom(map[string]*roomDefinition{"": defaultDefinition})
+	hosted, _ := r.lookup("lounge")
+	def := &roomDefinition{Exits: map[string]exitDefinition{"N": {}}}
+	userInfo := gameon.UserInfo{UserID: "u1", Username: "bob"}
+
+	for i := 1; i < r.strikes.kickAfter; i++ {
+		r.strikes.Strike(userInfo.UserID)
+	}
+
+	msgs := r.strike(hosted, def, userInfo)
+	if len(msgs) != 2 || msgs[1].Direction != "playerLocation" {
+		t.Fatalf("strike() = %+v, want the player kicked", msgs)
+	}
+
+	if left := r.strikes.Muted(userInfo.UserID); left != 0 {
+		t.Errorf("Muted() after a kick = %s, want 0", left)
+	}
+	if p, count := r.strikes.Strike(userInfo.UserID); p != warnPlayer || count != 1 {
+		t.Errorf("Strike() after a kick = %d, %d, want a warning and 1 strike", p, count)
+	}
+}
+
+func TestKickExit(t *testing.T) {
+	lounge := &roomDefinition{ID: "lounge", Exits: map[string]exitDefinition{
+		"D": {Target: "cellar"},
+		"E": {Target: "attic"},
+		"N": {},
+	}}
+	cellar := &roomDefinition{ID: "cellar", Exits: map[string]exitDefinition{"U": {Target: "lounge"}}}
+	attic := &roomDefinition{ID: "attic", Exits: map[string]exitDefinition{"D": {Target: "lounge"}}, KickExit: "D"}
+	r := newRoom(map[string]*roomDefinition{"lounge": lounge, "cellar": cellar, "attic": attic})
+
+	tests := []struct {
+		def  *roomDefinition
+		exit string
+	}{
+		// D and E lead to other rooms of the room service
+		{lounge, "N"},
+		// Rooms with every exit leading to the room service still kick players out
+		{cellar, "U"},
+		// The kick exit, wherever it leads
+		{attic, "D"},
+		{&roomDefinition{}, ""},
+	}
+
+	for _, test := range tests {
+		if exit := r.kickExit(test.def); exit != test.exit {
+			t.Errorf("kickExit(%s) = %q, want %q", test.def.ID, exit, test.exit)
+		}
+	}
+}
+
+func TestRoundUpToSecond(t *testing.T) {
+	tests := []struct {
+		d, rounded time.Duration
+	}{
+		{time.Millisecond, time.Second},
+		{time.Second, time.Second},
+		{time.Second + time.Nanosecond, 2 * time.Second},
+		{4*time.Minute + 59500*time.Millisecond, 5 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if rounded := roundUpToSecond(test.d); rounded != test.rounded {
+			t.Errorf("roundUpToSecond(%s) = %s, want %s", test.d, rounded, test.rounded)
+		}
+	}
+}
+
+func TestStrikesPruned(t *testing.T) {
+	s := newStrikes()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < minStrikesPrune; i++ {
+		s.Strike(fmt.Sprintf("u%d", i))
+	}
+	now = now.Add(s.window)
+
+	// Records are dropped once enough players got strikes
+	s.Strike("spammer")
+	if len(s.players) != 1 {
+		t.Errorf("%d players with records, want only the spammer's", len(s.players))
+	}
+
+	// A player's own record is dropped as soon as it's looked at
+	now = now.Add(s.muteDuration + s.window)
+	if left := s.Muted("spammer"); left != 0 || len(s.players) != 0 {
+		t.Errorf("Muted(spammer) = %s with %d players with records, want the record dropped", left, len(s.players))
+	}
+}
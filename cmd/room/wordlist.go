@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gameontext/a8-room/pkg/env"
+)
+
+const (
+	defaultWordListInterval = time.Minute
+	wordListTimeout         = 10 * time.Second
+)
+
+// wordList is a list of profanities, as read from a file or an HTTP endpoint.
+type wordList struct {
+	// Version identifies the list, and defaults to a digest of its content.
+	Version string `json:"version"`
+
+	// Language is the language of the list (e.g., "fr"), if it's particular to one.
+	Language string `json:"language"`
+
+	// Terms maps the profanities to their severity ("mild", "moderate" or "severe"), mild if left empty.
+	Terms map[string]string `json:"terms"`
+
+	// Allow holds words never reported as profanities, in spite of matching one.
+	Allow []string `json:"allow"`
+}
+
+// wordListStatus describes a word list in use.
+type wordListStatus struct {
+	Source   string `json:"source"`
+	Version  string `json:"version"`
+	Language string `json:"language,omitempty"`
+	Terms    int    `json:"terms"`
+}
+
+// activeWordLists is the matcher built from the word lists, along with what it was built from.
+type activeWordLists struct {
+	checker ProfanityChecker
+	digest  string
+
+	Version  string           `json:"version"`
+	Lists    []wordListStatus `json:"lists"`
+	Terms    int              `json:"terms"`
+	LoadedAt time.Time        `json:"loadedAt"`
+}
+
+// wordListChecker matches the profanities of word lists loaded from files or HTTP endpoints,
+// set with PROFANITY_LISTS. It watches the lists, and swaps its matcher as a whole when they change,
+// so that messages are always checked against a consistent set of lists.
+type wordListChecker struct {
+	sources []string
+
+	// languages restricts the lists in use to those in the given languages (and those particular to none).
+	languages []string
+
+	interval time.Duration
+	client   *http.Client
+
+	// active holds the *activeWordLists messages are checked against.
+	active atomic.Value
+}
+
+// newWordListChecker loads the comma separated word lists, which are file paths or HTTP URLs.
+// PROFANITY_LANGUAGES restricts the lists to the comma separated languages, and PROFANITY_LISTS_INTERVAL
+// sets how often they're checked for changes.
+func newWordListChecker(sources string) *wordListChecker {
+	c := &wordListChecker{
+		sources:   splitList(sources),
+		languages: splitList(strings.ToLower(os.Getenv("PROFANITY_LANGUAGES"))),
+		interval:  env.PositiveDuration("PROFANITY_LISTS_INTERVAL", defaultWordListInterval),
+		client:    &http.Client{Timeout: wordListTimeout},
+	}
+
+	active, err := c.load()
+	if err != nil {
+		panic(fmt.Sprintf("error loading profanity lists: %v", err))
+	}
+	c.activate(active)
+
+	return c
+}
+
+func (c *wordListChecker) Check(content string) []ProfanityMatch {
+	return c.current().checker.Check(content)
+}
+
+func (c *wordListChecker) current() *activeWordLists {
+	return c.active.Load().(*activeWordLists)
+}
+
+// Watch reloads the word lists periodically, swapping the matcher when they changed.
+// The current lists are kept when any of them fails to load.
+func (c *wordListChecker) Watch() {
+	for range time.Tick(c.interval) {
+		active, err := c.load()
+		if err != nil {
+			logrus.WithError(err).Errorf("Error reloading profanity lists, keeping version %s", c.current().Version)
+			continue
+		}
+
+		if active.digest != c.current().digest {
+			c.activate(active)
+		}
+	}
+}
+
+// ServeHTTP exposes the word lists in use as JSON.
+func (c *wordListChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, c.current())
+}
+
+func (c *wordListChecker) activate(active *activeWordLists) {
+	c.active.Store(active)
+	logrus.Infof("Using profanity lists version %s (%d terms from %d lists)", active.Version, active.Terms, len(active.Lists))
+}
+
+// load reads and merges the word lists, and builds a matcher from them.
+// Terms found in several lists take the highest severity.
+func (c *wordListChecker) load() (*activeWordLists, error) {
+	active := &activeWordLists{LoadedAt: time.Now()}
+
+	severities := make(map[string]Severity)
+	allowList := append([]string(nil), profanityAllowList()...)
+	var versions []string
+	digest := sha256.New()
+
+	for _, source := range c.sources {
+		data, err := c.read(source)
+		if err != nil {
+			return nil, fmt.Errorf("error reading profanity list %s: %v", source, err)
+		}
+
+		list, err := parseWordList(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profanity list %s: %v", source, err)
+		}
+
+		if list.Language != "" && len(c.languages) > 0 && !contains(c.languages, strings.ToLower(list.Language)) {
+			logrus.Debugf("Skipping profanity list %s in %s", source, list.Language)
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		if list.Version == "" {
+			list.Version = hex.EncodeToString(sum[:6])
+		}
+		digest.Write(sum[:])
+
+		for term, name := range list.Terms {
+			severity := severityOf(name)
+			if severity > severities[term] {
+				severities[term] = severity
+			}
+		}
+		allowList = append(allowList, list.Allow...)
+
+		versions = append(versions, list.Version)
+		active.Lists = append(active.Lists, wordListStatus{
+			Source:   source,
+			Version:  list.Version,
+			Language: list.Language,
+			Terms:    len(list.Terms),
+		})
+	}
+
+	terms := make([]string, 0, len(severities))
+	for term := range severities {
+		terms = append(terms, term)
+	}
+	// Sorting keeps the matcher the same from one load to the next
+	sort.Strings(terms)
+
+	profanities := make([]profanity, 0, len(terms))
+	for _, term := range terms {
+		profanities = append(profanities, profanity{term: term, severity: severities[term]})
+	}
+
+	active.checker = newProfanityMatcher(profanities, allowList)
+	active.digest = hex.EncodeToString(digest.Sum(nil))
+	active.Version = strings.Join(versions, "+")
+	active.Terms = len(profanities)
+	return active, nil
+}
+
+// read returns the content of the word list, from a file or an HTTP endpoint.
+func (c *wordListChecker) read(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	resp, err := c.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func parseWordList(data []byte) (*wordList, error) {
+	var list wordList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	terms := make(map[string]string, len(list.Terms))
+	for term, severity := range list.Terms {
+		// Terms are kept normalized, so that variants of a term are merged (e.g., "Crap" and "crap"),
+		// taking the highest severity
+		term = normalize(strings.TrimSpace(term)).text
+		if term == "" {
+			return nil, fmt.Errorf("empty term")
+		}
+		if severity != "" && severityOf(severity) == 0 {
+			return nil, fmt.Errorf("term %s has unknown severity %s", term, severity)
+		}
+		if previous, ok := terms[term]; !ok || severityOf(severity) > severityOf(previous) {
+			terms[term] = severity
+		}
+	}
+	list.Terms = terms
+
+	return &list, nil
+}
+
+// severityOf returns the severity with the given name (mild if empty), or 0 if there's no such severity.
+func severityOf(name string) Severity {
+	if name == "" {
+		return Mild
+	}
+	for severity, n := range severityNames {
+		if strings.EqualFold(n, name) {
+			return severity
+		}
+	}
+	return 0
+}
+
+// splitList splits a comma separated list, dropping empty values.
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
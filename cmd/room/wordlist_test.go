@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseWordListMergesVariants(t *testing.T) {
+	list, err := parseWordList([]byte(`{"terms": {"Crap": "mild", "crap": "severe", "CRAP": "", "zut": "moderate"}}`))
+	if err != nil {
+		t.Fatalf("parseWordList: %v", err)
+	}
+
+	if len(list.Terms) != 2 {
+		t.Errorf("parseWordList terms = %v, want crap and zut", list.Terms)
+	}
+	if severity := severityOf(list.Terms["crap"]); severity != Severe {
+		t.Errorf("crap severity = %s, want the highest of its variants, %s", severity, Severe)
+	}
+	if severity := severityOf(list.Terms["zut"]); severity != Moderate {
+		t.Errorf("zut severity = %s, want %s", severity, Moderate)
+	}
+}
+
+func TestParseWordListErrors(t *testing.T) {
+	tests := []string{
+		`{"terms": {" ": "mild"}}`,
+		`{"terms": {"crap": "awful"}}`,
+		`{"terms": ["crap"]}`,
+	}
+
+	for _, data := range tests {
+		if _, err := parseWordList([]byte(data)); err == nil {
+			t.Errorf("parseWordList(%s) succeeded, want an error", data)
+		}
+	}
+}
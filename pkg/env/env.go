@@ -0,0 +1,85 @@
+// Package env reads the settings of the room's microservices from environment variables.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Int returns the integer set with the environment variable, or defaultValue if it isn't set.
+// It panics if the value isn't a non-negative integer.
+func Int(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("invalid %s: %s", name, value))
+	}
+
+	return n
+}
+
+// Duration returns the duration set with the environment variable, or defaultValue if it isn't set.
+// It panics if the value isn't a non-negative duration.
+func Duration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		panic(fmt.Sprintf("invalid %s: %s", name, value))
+	}
+
+	return duration
+}
+
+// PositiveInt returns the integer set with the environment variable, or defaultValue if it isn't set,
+// for sizes and limits: zero and negative values are ignored with a warning, in favor of defaultValue.
+// It panics if the value isn't an integer.
+func PositiveInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s: %s", name, value))
+	}
+
+	if n <= 0 {
+		logrus.Warnf("Ignoring %s=%s, which must be positive, using %d", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return n
+}
+
+// PositiveDuration is like PositiveInt, for durations which can't be zero (e.g., a period or a timeout).
+func PositiveDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s: %s", name, value))
+	}
+
+	if duration <= 0 {
+		logrus.Warnf("Ignoring %s=%s, which must be positive, using %s", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return duration
+}
@@ -0,0 +1,312 @@
+package gameon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Message directions defined by the Game On websocket protocol.
+const (
+	// DirectionAck is sent by the room when a websocket connection is established.
+	DirectionAck = "ack"
+
+	// DirectionRoomHello is sent to the room when a player enters it.
+	DirectionRoomHello = "roomHello"
+
+	// DirectionRoomGoodbye is sent to the room when a player leaves it.
+	DirectionRoomGoodbye = "roomGoodbye"
+
+	// DirectionRoomJoin is sent to the room when a player joins it over an existing connection (protocol v2).
+	DirectionRoomJoin = "roomJoin"
+
+	// DirectionRoomPart is sent to the room when a player's connection goes away without leaving it (protocol v2).
+	DirectionRoomPart = "roomPart"
+
+	// DirectionRoom is sent to the room for player chat and slash commands.
+	DirectionRoom = "room"
+
+	// DirectionPlayer is sent by the room to a specific player, or to all players ("*").
+	DirectionPlayer = "player"
+
+	// DirectionPlayerLocation is sent by the room to move a player through an exit.
+	DirectionPlayerLocation = "playerLocation"
+)
+
+// AllRecipients is the recipient used to address every player in the room.
+const AllRecipients = "*"
+
+// FrameError is returned when a websocket frame is not of the form <direction>,[<recipient>,]{json}.
+type FrameError struct {
+	Frame  string
+	Reason string
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("invalid websocket frame (%s): %s", e.Reason, e.Frame)
+}
+
+// DirectionError is returned when a message carries a direction the codec doesn't know about.
+type DirectionError struct {
+	Direction string
+}
+
+func (e *DirectionError) Error() string {
+	return fmt.Sprintf("unrecognized message direction: %s", e.Direction)
+}
+
+// PayloadError is returned when a message payload can't be decoded into its typed form,
+// or is missing mandatory fields.
+type PayloadError struct {
+	Direction string
+	Reason    string
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("invalid '%s' message payload: %s", e.Direction, e.Reason)
+}
+
+// directionSpec describes the framing and payload decoding of a single message direction.
+type directionSpec struct {
+	hasRecipient bool
+	decode       func(payload json.RawMessage) (interface{}, error)
+}
+
+var directions = map[string]directionSpec{
+	DirectionAck:            {hasRecipient: false, decode: decodeAck},
+	DirectionRoomHello:      {hasRecipient: true, decode: decodeHello},
+	DirectionRoomGoodbye:    {hasRecipient: true, decode: decodeGoodbye},
+	DirectionRoomJoin:       {hasRecipient: true, decode: decodeJoin},
+	DirectionRoomPart:       {hasRecipient: true, decode: decodePart},
+	DirectionRoom:           {hasRecipient: true, decode: decodeRoomCommand},
+	DirectionPlayer:         {hasRecipient: true, decode: decodePlayer},
+	DirectionPlayerLocation: {hasRecipient: true, decode: decodePlayerLocation},
+}
+
+// NewMessage creates a message for the given direction and recipient, marshaling the payload to JSON.
+// The recipient is ignored for directions that don't carry one.
+func NewMessage(direction, recipient string, payload interface{}) (*Message, error) {
+	spec, ok := directions[direction]
+	if !ok {
+		return nil, &DirectionError{Direction: direction}
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, &PayloadError{Direction: direction, Reason: err.Error()}
+	}
+
+	msg := &Message{
+		Direction: direction,
+		Payload:   payloadBytes,
+	}
+	if spec.hasRecipient {
+		msg.Recipient = recipient
+	}
+
+	return msg, nil
+}
+
+// FormatMessage encodes a message into its websocket frame representation.
+func FormatMessage(msg *Message) ([]byte, error) {
+	spec, ok := directions[msg.Direction]
+	if !ok {
+		return nil, &DirectionError{Direction: msg.Direction}
+	}
+
+	if spec.hasRecipient && msg.Recipient == "" {
+		return nil, &PayloadError{Direction: msg.Direction, Reason: "missing recipient"}
+	}
+
+	if len(msg.Payload) == 0 || msg.Payload[0] != '{' {
+		return nil, &PayloadError{Direction: msg.Direction, Reason: "payload is not a JSON object"}
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(msg.Direction)
+	buf.WriteRune(',')
+
+	if spec.hasRecipient {
+		buf.WriteString(msg.Recipient)
+		buf.WriteRune(',')
+	}
+
+	buf.Write(msg.Payload)
+	return buf.Bytes(), nil
+}
+
+// ParseMessage decodes a websocket frame into a message.
+// Whether the frame carries a recipient is determined by its direction.
+// The payload is checked to be a JSON object, but is not decoded; use DecodePayload for that.
+func ParseMessage(data []byte) (*Message, error) {
+	direction, rest, ok := cutComma(data)
+	if !ok {
+		return nil, &FrameError{Frame: string(data), Reason: "missing direction"}
+	}
+
+	spec, ok := directions[string(direction)]
+	if !ok {
+		return nil, &DirectionError{Direction: string(direction)}
+	}
+
+	msg := &Message{Direction: string(direction)}
+
+	if spec.hasRecipient {
+		recipient, payload, ok := cutComma(rest)
+		if !ok || len(recipient) == 0 {
+			return nil, &FrameError{Frame: string(data), Reason: "missing recipient"}
+		}
+		msg.Recipient = string(recipient)
+		rest = payload
+	}
+
+	if trimmed := bytes.TrimSpace(rest); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, &FrameError{Frame: string(data), Reason: "payload is not a JSON object"}
+	}
+
+	msg.Payload = json.RawMessage(rest)
+	return msg, nil
+}
+
+// DecodePayload decodes the message payload into its typed form, according to the message direction.
+// The returned value is one of *Ack, *Hello, *Goodbye, *Join, *Part, *RoomCommand, *Location, *Chat, *Event or *PlayerLocation.
+func DecodePayload(msg *Message) (interface{}, error) {
+	spec, ok := directions[msg.Direction]
+	if !ok {
+		return nil, &DirectionError{Direction: msg.Direction}
+	}
+
+	payload, err := spec.decode(msg.Payload)
+	if err != nil {
+		return nil, &PayloadError{Direction: msg.Direction, Reason: err.Error()}
+	}
+
+	return payload, nil
+}
+
+// DecodeMessage parses a websocket frame and decodes its payload in a single step.
+func DecodeMessage(data []byte) (*Message, interface{}, error) {
+	msg, err := ParseMessage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := DecodePayload(msg)
+	if err != nil {
+		return msg, nil, err
+	}
+
+	return msg, payload, nil
+}
+
+func cutComma(data []byte) (before, after []byte, found bool) {
+	i := bytes.IndexByte(data, ',')
+	if i < 0 {
+		return data, nil, false
+	}
+	return data[:i], data[i+1:], true
+}
+
+func decodeAck(payload json.RawMessage) (interface{}, error) {
+	ack := &Ack{}
+	if err := json.Unmarshal(payload, ack); err != nil {
+		return nil, err
+	}
+	if len(ack.Version) == 0 {
+		return nil, fmt.Errorf("missing version")
+	}
+	return ack, nil
+}
+
+func decodeHello(payload json.RawMessage) (interface{}, error) {
+	hello := &Hello{}
+	if err := json.Unmarshal(payload, hello); err != nil {
+		return nil, err
+	}
+	if hello.UserID == "" {
+		return nil, fmt.Errorf("missing userId")
+	}
+	return hello, nil
+}
+
+func decodeGoodbye(payload json.RawMessage) (interface{}, error) {
+	goodbye := &Goodbye{}
+	if err := json.Unmarshal(payload, goodbye); err != nil {
+		return nil, err
+	}
+	if goodbye.UserID == "" {
+		return nil, fmt.Errorf("missing userId")
+	}
+	return goodbye, nil
+}
+
+func decodeJoin(payload json.RawMessage) (interface{}, error) {
+	join := &Join{}
+	if err := json.Unmarshal(payload, join); err != nil {
+		return nil, err
+	}
+	if join.UserID == "" {
+		return nil, fmt.Errorf("missing userId")
+	}
+	return join, nil
+}
+
+func decodePart(payload json.RawMessage) (interface{}, error) {
+	part := &Part{}
+	if err := json.Unmarshal(payload, part); err != nil {
+		return nil, err
+	}
+	if part.UserID == "" {
+		return nil, fmt.Errorf("missing userId")
+	}
+	return part, nil
+}
+
+func decodeRoomCommand(payload json.RawMessage) (interface{}, error) {
+	command := &RoomCommand{}
+	if err := json.Unmarshal(payload, command); err != nil {
+		return nil, err
+	}
+	if command.UserID == "" {
+		return nil, fmt.Errorf("missing userId")
+	}
+	return command, nil
+}
+
+func decodePlayer(payload json.RawMessage) (interface{}, error) {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &typed); err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	switch typed.Type {
+	case "location":
+		v = &Location{}
+	case "chat":
+		v = &Chat{}
+	case "event":
+		v = &Event{}
+	default:
+		return nil, fmt.Errorf("unrecognized payload type: %q", typed.Type)
+	}
+
+	if err := json.Unmarshal(payload, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodePlayerLocation(payload json.RawMessage) (interface{}, error) {
+	location := &PlayerLocation{}
+	if err := json.Unmarshal(payload, location); err != nil {
+		return nil, err
+	}
+	if location.Type == "" {
+		return nil, fmt.Errorf("missing type")
+	}
+	return location, nil
+}
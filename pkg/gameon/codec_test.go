@@ -0,0 +1,126 @@
+package gameon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	user := UserInfo{UserID: "dummy.GiantMuffin", Username: "GiantMuffin"}
+
+	tests := []struct {
+		direction string
+		recipient string
+		payload   interface{}
+	}{
+		{DirectionAck, "", &Ack{Version: []int{1, 2}}},
+		{DirectionRoomHello, "chatter", &Hello{UserInfo: user, Version: 2, Recovery: true, Bookmark: "42"}},
+		{DirectionRoomGoodbye, "chatter", &Goodbye{UserInfo: user}},
+		{DirectionRoomJoin, "chatter", &Join{UserInfo: user, Version: 2}},
+		{DirectionRoomPart, "chatter", &Part{UserInfo: user}},
+		{DirectionRoom, "chatter", &RoomCommand{UserInfo: user, Content: "hello, world"}},
+		{DirectionPlayer, user.UserID, &Location{
+			Type:        "location",
+			Name:        "chatter",
+			FullName:    "A chat room",
+			Description: "A dark room",
+			Exits:       map[string]string{"N": "A door"},
+			Commands:    map[string]string{"/look": "Look around"},
+			Inventory:   []string{"couch"},
+		}},
+		{DirectionPlayer, AllRecipients, &Chat{Type: "chat", Username: user.Username, Content: "hi, all", Bookmark: "7"}},
+		{DirectionPlayer, AllRecipients, &Event{Type: "event", Content: map[string]string{user.UserID: "Welcome!", "*": "Hi"}}},
+		{DirectionPlayerLocation, user.UserID, &PlayerLocation{Type: "exit", Content: "Bye", ExitID: "N"}},
+	}
+
+	for _, test := range tests {
+		msg, err := NewMessage(test.direction, test.recipient, test.payload)
+		if err != nil {
+			t.Fatalf("NewMessage(%s): %v", test.direction, err)
+		}
+
+		frame, err := FormatMessage(msg)
+		if err != nil {
+			t.Fatalf("FormatMessage(%s): %v", test.direction, err)
+		}
+
+		parsed, payload, err := DecodeMessage(frame)
+		if err != nil {
+			t.Fatalf("DecodeMessage(%q): %v", frame, err)
+		}
+
+		if parsed.Direction != test.direction || parsed.Recipient != test.recipient {
+			t.Errorf("DecodeMessage(%q) = %s,%s, want %s,%s", frame, parsed.Direction, parsed.Recipient, test.direction, test.recipient)
+		}
+		if !reflect.DeepEqual(payload, test.payload) {
+			t.Errorf("DecodeMessage(%q) payload = %#v, want %#v", frame, payload, test.payload)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := []struct {
+		frame string
+		err   error
+	}{
+		{`roomHello`, &FrameError{}},
+		{`roomHello,{"userId":"x"}`, &FrameError{}},
+		{`roomHello,,{"userId":"x"}`, &FrameError{}},
+		{`room,chatter,hello`, &FrameError{}},
+		{`ack,`, &FrameError{}},
+		{`shout,chatter,{}`, &DirectionError{}},
+		{`,chatter,{}`, &DirectionError{}},
+	}
+
+	for _, test := range tests {
+		_, err := ParseMessage([]byte(test.frame))
+		if reflect.TypeOf(err) != reflect.TypeOf(test.err) {
+			t.Errorf("ParseMessage(%q) error = %v, want a %T", test.frame, err, test.err)
+		}
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	tests := []string{
+		`ack,{}`,
+		`ack,{"version":"1"}`,
+		`roomHello,chatter,{"username":"GiantMuffin"}`,
+		`roomGoodbye,chatter,{}`,
+		`roomJoin,chatter,{}`,
+		`roomPart,chatter,{}`,
+		`room,chatter,{"content":"hi"}`,
+		`room,chatter,{"userId":`,
+		`player,*,{"type":"shout"}`,
+		`player,*,{"type":"event","content":"hi"}`,
+		`playerLocation,x,{"content":"bye"}`,
+	}
+
+	for _, frame := range tests {
+		_, _, err := DecodeMessage([]byte(frame))
+		if _, ok := err.(*PayloadError); !ok {
+			t.Errorf("DecodeMessage(%q) error = %v, want a *PayloadError", frame, err)
+		}
+	}
+}
+
+func TestFormatMessageErrors(t *testing.T) {
+	tests := []struct {
+		msg *Message
+		err error
+	}{
+		{&Message{Direction: "shout", Recipient: "*", Payload: []byte(`{}`)}, &DirectionError{}},
+		{&Message{Direction: DirectionPlayer, Payload: []byte(`{}`)}, &PayloadError{}},
+		{&Message{Direction: DirectionPlayer, Recipient: "*", Payload: []byte(`"hi"`)}, &PayloadError{}},
+	}
+
+	for _, test := range tests {
+		_, err := FormatMessage(test.msg)
+		if reflect.TypeOf(err) != reflect.TypeOf(test.err) {
+			t.Errorf("FormatMessage(%+v) error = %v, want a %T", test.msg, err, test.err)
+		}
+	}
+
+	if _, err := NewMessage("shout", "*", struct{}{}); err == nil {
+		t.Errorf("NewMessage(shout) succeeded, want a *DirectionError")
+	}
+}
@@ -0,0 +1,81 @@
+package gameon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// identitySignedHeaders are the headers scoping a request which the identity signature covers, so that
+// a signed request can't be replayed against another room, or with another idempotency key.
+var identitySignedHeaders = []string{RoomIDHeader, IdempotencyKeyHeader}
+
+// SignIdentity sets the user identity headers on a request in between the room's microservices,
+// along with a signature covering the user ID, username, signing date, request method, endpoint, body
+// and scoping headers (see identitySignedHeaders), which must be set beforehand.
+func SignIdentity(req *http.Request, secret []byte, userInfo UserInfo, body []byte, now time.Time) {
+	date := now.UTC().Format(http.TimeFormat)
+
+	req.Header.Set(UserIDHeader, userInfo.UserID)
+	req.Header.Set(UsernameHeader, userInfo.Username)
+	req.Header.Set(IdentityDateHeader, date)
+	req.Header.Set(IdentitySignatureHeader, Sign(secret, identityParts(req, userInfo, date, body)...))
+}
+
+// identityParts returns the parts of a request the identity signature covers.
+// The endpoint is the last element of the URL path, as the proxy in between the services (e.g., the Amalgam8
+// sidecar) may strip a prefix: it's enough to keep a signed /hello from being replayed to /goodbye.
+func identityParts(req *http.Request, userInfo UserInfo, date string, body []byte) []string {
+	parts := []string{userInfo.UserID, "\n", userInfo.Username, "\n", date, "\n", hashBody(body),
+		"\n", req.Method, "\n", path.Base(req.URL.Path)}
+	for _, header := range identitySignedHeaders {
+		parts = append(parts, "\n", req.Header.Get(header))
+	}
+	return parts
+}
+
+// VerifyIdentity checks the signed identity headers of a request against its body,
+// and returns the verified user identity.
+// The user ID and username carried in the JSON body, if any, must match the signed headers.
+func VerifyIdentity(req *http.Request, secret []byte, body []byte, maxAge time.Duration, now time.Time) (UserInfo, error) {
+	userInfo := UserInfo{
+		UserID:   req.Header.Get(UserIDHeader),
+		Username: req.Header.Get(UsernameHeader),
+	}
+	date := req.Header.Get(IdentityDateHeader)
+	signature := req.Header.Get(IdentitySignatureHeader)
+
+	if date == "" || signature == "" {
+		return UserInfo{}, fmt.Errorf("missing identity signature headers")
+	}
+
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("invalid identity signature date: %s", date)
+	}
+
+	age := now.Sub(signedAt)
+	if age < -maxAge || age > maxAge {
+		return UserInfo{}, fmt.Errorf("stale identity signature date: %s", date)
+	}
+
+	if !VerifySignature(secret, signature, identityParts(req, userInfo, date, body)...) {
+		return UserInfo{}, fmt.Errorf("identity signature mismatch for user %s", userInfo.UserID)
+	}
+
+	if len(body) > 0 {
+		var bodyInfo UserInfo
+		err = json.Unmarshal(body, &bodyInfo)
+		if err != nil {
+			return UserInfo{}, fmt.Errorf("invalid request body: %v", err)
+		}
+
+		if bodyInfo.UserID != userInfo.UserID || bodyInfo.Username != userInfo.Username {
+			return UserInfo{}, fmt.Errorf("request body identity (%s) doesn't match signed identity (%s)", bodyInfo.UserID, userInfo.UserID)
+		}
+	}
+
+	return userInfo, nil
+}
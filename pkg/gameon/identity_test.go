@@ -0,0 +1,66 @@
+package gameon
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newSignedRequest(secret []byte, roomID string, body []byte, now time.Time) *http.Request {
+	req, _ := http.NewRequest("POST", "http://localhost:6379/room/hello", bytes.NewReader(body))
+	req.Header.Set(RoomIDHeader, roomID)
+	req.Header.Set(IdempotencyKeyHeader, "key")
+	SignIdentity(req, secret, UserInfo{UserID: "dummy.GiantMuffin", Username: "GiantMuffin"}, body, now)
+	return req
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"userId":"dummy.GiantMuffin","username":"GiantMuffin","content":"hi"}`)
+	now := time.Now()
+
+	// The room service sees the request without the prefix the proxy in between routes on
+	req := newSignedRequest(secret, "chatter", body, now)
+	req.URL.Path = "/hello"
+
+	userInfo, err := VerifyIdentity(req, secret, body, time.Minute, now)
+	if err != nil {
+		t.Fatalf("VerifyIdentity: %v", err)
+	}
+	if userInfo.UserID != "dummy.GiantMuffin" || userInfo.Username != "GiantMuffin" {
+		t.Errorf("VerifyIdentity = %+v", userInfo)
+	}
+}
+
+func TestVerifyIdentityRejected(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"userId":"dummy.GiantMuffin","username":"GiantMuffin","content":"hi"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		secret []byte
+		body   []byte
+	}{
+		{"wrong secret", newSignedRequest(secret, "chatter", body, now), []byte("guess"), body},
+		{"tampered body", newSignedRequest(secret, "chatter", body, now), secret, []byte(`{"userId":"dummy.GiantMuffin","username":"GiantMuffin","content":"bye"}`)},
+		{"stale date", newSignedRequest(secret, "chatter", body, now.Add(-time.Hour)), secret, body},
+		{"other room", newSignedRequest(secret, "chatter", body, now), secret, body},
+		{"other idempotency key", newSignedRequest(secret, "chatter", body, now), secret, body},
+		{"other user in body", newSignedRequest(secret, "chatter", []byte(`{"userId":"someone.else"}`), now), secret, []byte(`{"userId":"someone.else"}`)},
+		{"other path", newSignedRequest(secret, "chatter", body, now), secret, body},
+		{"other method", newSignedRequest(secret, "chatter", body, now), secret, body},
+	}
+	tests[3].req.Header.Set(RoomIDHeader, "lobby")
+	tests[4].req.Header.Set(IdempotencyKeyHeader, "other key")
+	tests[6].req.URL.Path = "/room/goodbye"
+	tests[7].req.Method = "PUT"
+
+	for _, test := range tests {
+		if _, err := VerifyIdentity(test.req, test.secret, test.body, time.Minute, now); err == nil {
+			t.Errorf("%s: VerifyIdentity succeeded, want an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package gameon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SignatureBodyHeader carries the base64-encoded SHA-256 hash of a signed request body.
+const SignatureBodyHeader = "gameon-sig-body"
+
+// RoomInfo describes a room, as registered with the Game On map service.
+type RoomInfo struct {
+	Name              string             `json:"name"`
+	FullName          string             `json:"fullName,omitempty"`
+	Description       string             `json:"description,omitempty"`
+	Doors             map[string]string  `json:"doors,omitempty"`
+	ConnectionDetails *ConnectionDetails `json:"connectionDetails,omitempty"`
+}
+
+// ConnectionDetails describes how Game On should connect to a room.
+type ConnectionDetails struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Token  string `json:"token,omitempty"`
+}
+
+// Site is a room's location on the Game On map.
+type Site struct {
+	ID    string    `json:"_id,omitempty"`
+	Owner string    `json:"owner,omitempty"`
+	Info  *RoomInfo `json:"info,omitempty"`
+}
+
+// MapError is returned when the map service responds with a non-2xx status code.
+type MapError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *MapError) Error() string {
+	return fmt.Sprintf("map service responded with %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// MapClient is a client for the Game On map service, signing every request with the owner's shared secret.
+type MapClient struct {
+	// URL is the base URL of the map service API, e.g. "https://gameontext.org/map/v1".
+	URL string
+
+	// ID is the Game On user ID owning the registered rooms.
+	ID string
+
+	// Secret is the shared secret of the owning user.
+	Secret []byte
+
+	HTTPClient *http.Client
+
+	now func() time.Time
+}
+
+// NewMapClient creates a map service client for the given owner ID and shared secret.
+func NewMapClient(url, id string, secret []byte) *MapClient {
+	return &MapClient{
+		URL:        strings.TrimSuffix(url, "/"),
+		ID:         id,
+		Secret:     secret,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+// FindSites returns the sites owned by the client's user ID, having the given room name.
+func (c *MapClient) FindSites(name string) ([]Site, error) {
+	query := url.Values{}
+	query.Set("owner", c.ID)
+	query.Set("name", name)
+
+	var sites []Site
+	err := c.do("GET", "/sites?"+query.Encode(), nil, &sites)
+	if err != nil {
+		return nil, err
+	}
+
+	return sites, nil
+}
+
+// CreateSite registers a new room with the map service.
+func (c *MapClient) CreateSite(info *RoomInfo) (*Site, error) {
+	var site Site
+	err := c.do("POST", "/sites", info, &site)
+	if err != nil {
+		return nil, err
+	}
+
+	return &site, nil
+}
+
+// UpdateSite updates the room information of an existing site.
+func (c *MapClient) UpdateSite(siteID string, info *RoomInfo) (*Site, error) {
+	var site Site
+	err := c.do("PUT", "/sites/"+url.PathEscape(siteID), info, &site)
+	if err != nil {
+		return nil, err
+	}
+
+	return &site, nil
+}
+
+// Register creates the room's site if it doesn't exist yet, or updates it otherwise.
+// Sites are matched by owner and room name.
+func (c *MapClient) Register(info *RoomInfo) (*Site, error) {
+	sites, err := c.FindSites(info.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(sites) {
+	case 0:
+		return c.CreateSite(info)
+	case 1:
+		return c.UpdateSite(sites[0].ID, info)
+	default:
+		return nil, fmt.Errorf("found %d sites named %s, expected at most one", len(sites), info.Name)
+	}
+}
+
+func (c *MapClient) do(method, path string, body interface{}, result interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		bodyBytes, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	c.sign(req, bodyBytes)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &MapError{StatusCode: resp.StatusCode, Body: string(respBytes)}
+	}
+
+	if result == nil || len(respBytes) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(respBytes, result)
+}
+
+func (c *MapClient) sign(req *http.Request, body []byte) {
+	date := c.now().UTC().Format(http.TimeFormat)
+	bodyHash := hashBody(body)
+
+	req.Header.Set(SignatureIDHeader, c.ID)
+	req.Header.Set(SignatureDateHeader, date)
+	req.Header.Set(SignatureBodyHeader, bodyHash)
+	req.Header.Set(SignatureHeader, Sign(c.Secret, c.ID, date, bodyHash))
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,106 @@
+package gameon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMapService() (*FakeMapService, *httptest.Server) {
+	fake := NewFakeMapService(map[string][]byte{
+		"owner": []byte("secret"),
+		"other": []byte("other secret"),
+	})
+	return fake, httptest.NewServer(fake)
+}
+
+func TestMapClientRegister(t *testing.T) {
+	fake, server := newTestMapService()
+	defer server.Close()
+
+	client := NewMapClient(server.URL, "owner", []byte("secret"))
+
+	created, err := client.Register(&RoomInfo{Name: "chatter", FullName: "A chat room"})
+	if err != nil {
+		t.Fatalf("Register (create): %v", err)
+	}
+	if created.ID == "" || created.Owner != "owner" || created.Info.FullName != "A chat room" {
+		t.Errorf("Register (create) = %+v", created)
+	}
+
+	updated, err := client.Register(&RoomInfo{Name: "chatter", FullName: "The chat room"})
+	if err != nil {
+		t.Fatalf("Register (update): %v", err)
+	}
+	if updated.ID != created.ID || updated.Info.FullName != "The chat room" {
+		t.Errorf("Register (update) = %+v, want site %s updated", updated, created.ID)
+	}
+
+	if sites := fake.Sites(); len(sites) != 1 || sites[0].Info.FullName != "The chat room" {
+		t.Errorf("Sites() = %+v, want the updated site only", sites)
+	}
+}
+
+func TestMapClientUpdateOtherOwner(t *testing.T) {
+	_, server := newTestMapService()
+	defer server.Close()
+
+	site, err := NewMapClient(server.URL, "owner", []byte("secret")).CreateSite(&RoomInfo{Name: "chatter"})
+	if err != nil {
+		t.Fatalf("CreateSite: %v", err)
+	}
+
+	_, err = NewMapClient(server.URL, "other", []byte("other secret")).UpdateSite(site.ID, &RoomInfo{Name: "mine"})
+	if mapErr, ok := err.(*MapError); !ok || mapErr.StatusCode != http.StatusForbidden {
+		t.Errorf("UpdateSite by another owner: error = %v, want 403", err)
+	}
+}
+
+func TestMapClientSignatureRejected(t *testing.T) {
+	_, server := newTestMapService()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		client *MapClient
+	}{
+		{"wrong secret", NewMapClient(server.URL, "owner", []byte("guess"))},
+		{"unknown owner", NewMapClient(server.URL, "stranger", []byte("secret"))},
+		{"stale date", NewMapClient(server.URL, "owner", []byte("secret"))},
+		{"future date", NewMapClient(server.URL, "owner", []byte("secret"))},
+	}
+	tests[2].client.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	tests[3].client.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	for _, test := range tests {
+		_, err := test.client.CreateSite(&RoomInfo{Name: "chatter"})
+		if mapErr, ok := err.(*MapError); !ok || mapErr.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: error = %v, want 403", test.name, err)
+		}
+	}
+}
+
+func TestFakeMapServiceBodyTampered(t *testing.T) {
+	_, server := newTestMapService()
+	defer server.Close()
+
+	client := NewMapClient(server.URL, "owner", []byte("secret"))
+	client.HTTPClient.Transport = tamperingTransport{}
+
+	_, err := client.CreateSite(&RoomInfo{Name: "chatter"})
+	if mapErr, ok := err.(*MapError); !ok || mapErr.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered body: error = %v, want 403", err)
+	}
+}
+
+// tamperingTransport replaces request bodies after they were signed.
+type tamperingTransport struct{}
+
+func (tamperingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `{"name":"evil"}`
+	tampered, _ := http.NewRequest(req.Method, req.URL.String(), strings.NewReader(body))
+	tampered.Header = req.Header
+	return http.DefaultTransport.RoundTrip(tampered)
+}
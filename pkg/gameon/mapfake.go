@@ -0,0 +1,187 @@
+package gameon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mapSignatureMaxAge bounds the clock skew allowed for signed map service requests, as the real service does.
+const mapSignatureMaxAge = 5 * time.Minute
+
+// FakeMapService is an in-memory stand-in for the Game On map service, meant for offline testing.
+// It serves the subset of the map API used by MapClient, and verifies request signatures
+// against the shared secrets it was given.
+//
+// Use it with net/http/httptest:
+//
+//	fake := gameon.NewFakeMapService(map[string][]byte{"owner": secret})
+//	server := httptest.NewServer(fake)
+//	client := gameon.NewMapClient(server.URL, "owner", secret)
+type FakeMapService struct {
+	secrets map[string][]byte
+	sites   map[string]*Site
+	nextID  int
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+// NewFakeMapService creates a fake map service accepting requests from the given owner IDs and secrets.
+func NewFakeMapService(secrets map[string][]byte) *FakeMapService {
+	return &FakeMapService{
+		secrets: secrets,
+		sites:   make(map[string]*Site),
+		now:     time.Now,
+	}
+}
+
+// Sites returns a snapshot of the registered sites.
+func (f *FakeMapService) Sites() []Site {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	sites := make([]Site, 0, len(f.sites))
+	for _, site := range f.sites {
+		sites = append(sites, *site)
+	}
+
+	return sites
+}
+
+func (f *FakeMapService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	owner, err := f.verify(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/sites" && r.Method == "GET":
+		f.findSites(w, r)
+	case path == "/sites" && r.Method == "POST":
+		f.createSite(w, owner, body)
+	case strings.HasPrefix(path, "/sites/") && r.Method == "PUT":
+		f.updateSite(w, owner, strings.TrimPrefix(path, "/sites/"), body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *FakeMapService) verify(r *http.Request, body []byte) (string, error) {
+	id := r.Header.Get(SignatureIDHeader)
+	date := r.Header.Get(SignatureDateHeader)
+	bodyHash := r.Header.Get(SignatureBodyHeader)
+	signature := r.Header.Get(SignatureHeader)
+
+	secret, ok := f.secrets[id]
+	if !ok {
+		return "", fmt.Errorf("unknown id: %s", id)
+	}
+
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return "", fmt.Errorf("invalid date: %s", date)
+	}
+
+	age := f.now().Sub(signedAt)
+	if age < -mapSignatureMaxAge || age > mapSignatureMaxAge {
+		return "", fmt.Errorf("stale date: %s", date)
+	}
+
+	if bodyHash != hashBody(body) {
+		return "", fmt.Errorf("body hash mismatch")
+	}
+
+	if !VerifySignature(secret, signature, id, date, bodyHash) {
+		return "", fmt.Errorf("signature mismatch")
+	}
+
+	return id, nil
+}
+
+func (f *FakeMapService) findSites(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	owner := r.URL.Query().Get("owner")
+	name := r.URL.Query().Get("name")
+
+	sites := []Site{}
+	for _, site := range f.sites {
+		if owner != "" && site.Owner != owner {
+			continue
+		}
+		if name != "" && site.Info.Name != name {
+			continue
+		}
+		sites = append(sites, *site)
+	}
+
+	writeJSON(w, http.StatusOK, sites)
+}
+
+func (f *FakeMapService) createSite(w http.ResponseWriter, owner string, body []byte) {
+	var info RoomInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil || info.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.nextID++
+	site := &Site{
+		ID:    fmt.Sprintf("site-%d", f.nextID),
+		Owner: owner,
+		Info:  &info,
+	}
+	f.sites[site.ID] = site
+
+	writeJSON(w, http.StatusCreated, site)
+}
+
+func (f *FakeMapService) updateSite(w http.ResponseWriter, owner, siteID string, body []byte) {
+	var info RoomInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil || info.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	site, ok := f.sites[siteID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if site.Owner != owner {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	site.Info = &info
+	writeJSON(w, http.StatusOK, site)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
@@ -7,4 +7,16 @@ const (
 
 	// UsernameHeader carries the Game On user name.
 	UsernameHeader = "X-Game-On-Username"
+
+	// IdentityDateHeader carries the date the identity headers were signed at, in HTTP date format.
+	IdentityDateHeader = "X-Game-On-Date"
+
+	// IdentitySignatureHeader carries the signature of the identity headers and the request body.
+	IdentitySignatureHeader = "X-Game-On-Signature"
+
+	// RoomIDHeader carries the ID of the room a call is meant for, when the room service hosts several rooms.
+	RoomIDHeader = "X-Game-On-Room"
+
+	// IdempotencyKeyHeader carries a key identifying a call, reused across its retries.
+	IdempotencyKeyHeader = "Idempotency-Key"
 )
@@ -0,0 +1,36 @@
+package gameon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Headers carrying the Game On request signature, used on the websocket handshake
+// and on calls to the Game On map service.
+const (
+	// SignatureIDHeader carries the ID of the signing party.
+	SignatureIDHeader = "gameon-id"
+
+	// SignatureDateHeader carries the date the request was signed at, in HTTP date format.
+	SignatureDateHeader = "gameon-date"
+
+	// SignatureHeader carries the base64-encoded HMAC-SHA256 signature.
+	SignatureHeader = "gameon-signature"
+)
+
+// Sign computes the base64-encoded HMAC-SHA256 of the concatenated parts, keyed with the shared secret.
+func Sign(secret []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		mac.Write([]byte(part))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether the signature matches the concatenated parts, keyed with the shared secret.
+// The comparison is done in constant time.
+func VerifySignature(secret []byte, signature string, parts ...string) bool {
+	expected := Sign(secret, parts...)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
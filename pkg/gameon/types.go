@@ -9,10 +9,14 @@ type MessageCollection struct {
 
 // Message is a generic GameOn! message, holding a direction (player, room, ...),
 // a recipient (playerID, roomID, *, ...), and a message-type specific payload.
+//
+// Room identifies the room a message sent by the room service comes from, when the service hosts several rooms.
+// It scopes messages sent to everyone (*) to the players in that room, and isn't part of the websocket frame.
 type Message struct {
 	Direction string          `json:"direction,omitempty"`
 	Recipient string          `json:"recipient,omitempty"`
 	Payload   json.RawMessage `json:"payload,omitempty"`
+	Room      string          `json:"room,omitempty"`
 }
 
 // UserInfo holds the ID and username of a GameOn! client.
@@ -29,10 +33,12 @@ type RoomCommand struct {
 }
 
 // Hello is the message payload provided for a [mediator --> room] hello message.
+// When recovering a session, Bookmark optionally holds the bookmark of the last chat or event message the player got.
 type Hello struct {
 	UserInfo
-	Version  int  `json:"version,omitempty"`
-	Recovery bool `json:"recovery,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Recovery bool   `json:"recovery,omitempty"`
+	Bookmark string `json:"bookmark,omitempty"`
 }
 
 // Goodbye is the message payload provided for a [mediator --> room] goodbye message.
@@ -40,6 +46,19 @@ type Goodbye struct {
 	UserInfo
 }
 
+// Join is the message payload provided for a [mediator --> room] join message (protocol v2).
+// It is sent when a player joins the room over an already established connection.
+type Join struct {
+	UserInfo
+	Version int `json:"version,omitempty"`
+}
+
+// Part is the message payload provided for a [mediator --> room] part message (protocol v2).
+// It is sent when a player's connection to the room is going away, without the player leaving the room.
+type Part struct {
+	UserInfo
+}
+
 // Ack is the message payload provided for a [room --> mediator] ack message.
 type Ack struct {
 	Version []int `json:"version,omitempty"`